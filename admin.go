@@ -0,0 +1,341 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"sort"
+	"strconv"
+	"strings"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// isAdmin reports whether the user is one of the admins of the bot.
+func isAdmin(admins []string, userID id.UserID) bool {
+	for _, admin := range admins {
+		if id.UserID(admin) == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// handleAdminCommand runs the commands of admins in the admin room. Every
+// command is logged. Messages of others and edits are ignored. Commands which
+// take long, like broadcasts, send their result with report once done.
+func handleAdminCommand(data *store, admins []string, ev *event.Event, report func(cmdReply)) []cmdReply {
+	content := ev.Content.AsMessage()
+	if !isAdmin(admins, ev.Sender) || replacedEvent(content) != "" {
+		return nil
+	}
+
+	body := strings.TrimSpace(content.Body)
+	if body == "" {
+		return nil
+	}
+
+	fmt.Println("Admin command:", ev.Sender, body)
+	err := data.persist.addAdminLog(ev.Sender, body)
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	reply, err := runAdminCommand(data, body, report)
+	if err != nil {
+		fmt.Println(err)
+		return []cmdReply{{"Oops, something went wrong", ""}}
+	}
+
+	return []cmdReply{reply}
+}
+
+func runAdminCommand(data *store, body string, report func(cmdReply)) (cmdReply, error) {
+	rawArgs := strings.Fields(body)
+	args := strings.Fields(strings.ToLower(body))
+
+	switch args[0] {
+	case "stats":
+		return cmdAdminStats(data)
+	case "users":
+		return cmdAdminUsers(data), nil
+	case "user":
+		if len(args) < 3 {
+			return formatHelp(helpAdmin), nil
+		}
+
+		u := data.knownUser(id.UserID(rawArgs[1]))
+		if u == nil {
+			return cmdReply{"Unknown user: " + rawArgs[1], ""}, nil
+		}
+
+		switch args[2] {
+		case "calendars":
+			return cmdAdminUserCalendars(u), nil
+		case "disable":
+			return cmdAdminUserDisable(u, true)
+		case "enable":
+			return cmdAdminUserDisable(u, false)
+		}
+	case "broadcast":
+		msg := strings.TrimSpace(strings.TrimPrefix(body, rawArgs[0]))
+		if msg == "" {
+			return formatUsage(usageAdminBroadcast), nil
+		}
+		return cmdAdminBroadcast(data, msg, report), nil
+	case "reload":
+		return cmdAdminReload(data), nil
+	case "help", "?":
+		return formatHelp(helpAdmin), nil
+	}
+
+	return formatHelp(helpAdmin), nil
+}
+
+// knownUser gives the user or group room with the given ID, or nil. Unlike
+// user, it doesn't create the user.
+func (s *store) knownUser(userID id.UserID) *user {
+	s.usersMutex.RLock()
+	defer s.usersMutex.RUnlock()
+	return s.users[userID]
+}
+
+// allUsers gives the users and group rooms, sorted by ID.
+func (s *store) allUsers() []*user {
+	s.usersMutex.RLock()
+	users := make([]*user, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, u)
+	}
+	s.usersMutex.RUnlock()
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].userID < users[j].userID
+	})
+	return users
+}
+
+func (u *user) isDisabled() bool {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	return u.disabled
+}
+
+// setDisabled disables or enables the user. Disabled users are ignored, and
+// don't get reminders, digests and weekly messages.
+func (u *user) setDisabled(disabled bool) error {
+	u.mutex.RLock()
+	userID := u.userID
+	u.mutex.RUnlock()
+
+	err := u.persist.updateUserDisabled(userID, disabled)
+	if err != nil {
+		return err
+	}
+
+	u.mutex.Lock()
+	u.disabled = disabled
+	u.mutex.Unlock()
+
+	if disabled {
+		u.stopTimers()
+		return nil
+	}
+
+	u.restartDigestTimer()
+	u.restartWeeklyTimers()
+	return u.restartReminderTimer()
+}
+
+func cmdAdminStats(data *store) (cmdReply, error) {
+	users, groupRooms, left, disabled, calendars := 0, 0, 0, 0, 0
+	for _, u := range data.allUsers() {
+		if !u.ExistsInDB() {
+			continue
+		}
+
+		if u.isGroupRoom() {
+			groupRooms++
+		} else {
+			users++
+		}
+		if u.hasLeft() {
+			left++
+		}
+		if u.isDisabled() {
+			disabled++
+		}
+
+		u.calendarsMutex.RLock()
+		calendars += len(u.calendars)
+		u.calendarsMutex.RUnlock()
+	}
+
+	pending, failed, err := data.persist.countOutbox()
+	if err != nil {
+		return cmdReply{}, err
+	}
+
+	lines := []string{
+		"users: " + strconv.Itoa(users),
+		"group rooms: " + strconv.Itoa(groupRooms),
+		"left: " + strconv.Itoa(left),
+		"disabled: " + strconv.Itoa(disabled),
+		"calendars: " + strconv.Itoa(calendars),
+		"messages waiting to be sent: " + strconv.Itoa(pending),
+		"messages which couldn't be sent: " + strconv.Itoa(failed),
+	}
+
+	return cmdReply{strings.Join(lines, "\n"), strings.Join(lines, "<br />\n")}, nil
+}
+
+func cmdAdminUsers(data *store) cmdReply {
+	lines := []string{}
+	linesF := []string{}
+
+	for _, u := range data.allUsers() {
+		if !u.ExistsInDB() {
+			continue
+		}
+
+		u.calendarsMutex.RLock()
+		calendars := len(u.calendars)
+		u.calendarsMutex.RUnlock()
+
+		info := []string{strconv.Itoa(calendars) + " calendars"}
+		if u.isGroupRoom() {
+			info = append(info, "group room")
+		}
+		if u.hasLeft() {
+			info = append(info, "left")
+		}
+		if u.isDisabled() {
+			info = append(info, "disabled")
+		}
+
+		lines = append(lines, fmt.Sprintf("* %s (%s)", u.userID, strings.Join(info, ", ")))
+		linesF = append(linesF, fmt.Sprintf("&nbsp;&#9702; <code>%s</code> (%s)", html.EscapeString(string(u.userID)), strings.Join(info, ", ")))
+	}
+
+	if len(lines) == 0 {
+		return cmdReply{"There are no users yet", ""}
+	}
+
+	return cmdReply{strings.Join(lines, "\n"), strings.Join(linesF, "<br />\n")}
+}
+
+// cmdAdminUserCalendars lists the calendars of the user. Their addresses
+// aren't shown, as they often contain credentials.
+func cmdAdminUserCalendars(u *user) cmdReply {
+	lines := []string{}
+	linesF := []string{}
+
+	u.calendarsMutex.RLock()
+	for _, uc := range u.calendars {
+		info := string(uc.CalType)
+		if roomID := uc.room(); roomID != "" {
+			info += ", room: " + string(roomID)
+		}
+
+		lines = append(lines, fmt.Sprintf("* %s (%s)", uc.Name, info))
+		linesF = append(linesF, fmt.Sprintf("&nbsp;&#9702; <b>%s</b> (%s)", html.EscapeString(uc.Name), html.EscapeString(info)))
+	}
+	u.calendarsMutex.RUnlock()
+
+	if len(lines) == 0 {
+		return cmdReply{string(u.userID) + " has no calendars", ""}
+	}
+
+	return cmdReply{strings.Join(lines, "\n"), strings.Join(linesF, "<br />\n")}
+}
+
+func cmdAdminUserDisable(u *user, disabled bool) (cmdReply, error) {
+	err := u.setDisabled(disabled)
+	if err != nil {
+		return cmdReply{}, err
+	}
+
+	if disabled {
+		return cmdReply{"Disabled " + string(u.userID), ""}, nil
+	}
+	return cmdReply{"Enabled " + string(u.userID), ""}, nil
+}
+
+// cmdAdminBroadcast sends the message to the rooms of all users and group
+// rooms, except those which left or are disabled. The messages are sent in
+// the background, the result is sent with report once all are sent.
+func cmdAdminBroadcast(data *store, msg string, report func(cmdReply)) cmdReply {
+	recipients := []*user{}
+	for _, u := range data.allUsers() {
+		if u.RoomID() == "" || u.hasLeft() || u.isDisabled() {
+			continue
+		}
+		recipients = append(recipients, u)
+	}
+
+	go func() {
+		pending := make([]pendingMessage, len(recipients))
+		for i, u := range recipients {
+			pending[i] = u.messageSender().sendNotice(u.RoomID(), msg, "")
+		}
+
+		sent, failed := 0, 0
+		for i, p := range pending {
+			_, err := p.wait()
+			if err != nil {
+				fmt.Println("broadcast:", recipients[i].userID, err)
+				failed++
+				continue
+			}
+			sent++
+		}
+
+		if failed > 0 {
+			report(cmdReply{fmt.Sprintf("Sent the message to %d rooms, failed for %d rooms", sent, failed), ""})
+			return
+		}
+		report(cmdReply{fmt.Sprintf("Sent the message to %d rooms", sent), ""})
+	}()
+
+	return cmdReply{fmt.Sprintf("Sending the message to %d rooms…", len(recipients)), ""}
+}
+
+// cmdAdminReload makes all calendars fetch their events again, and restarts
+// the reminders with the new events.
+func cmdAdminReload(data *store) cmdReply {
+	calendars := 0
+	for _, u := range data.allUsers() {
+		u.calendarsMutex.RLock()
+		for _, uc := range u.calendars {
+			uc.reload()
+			calendars++
+		}
+		u.calendarsMutex.RUnlock()
+
+		err := u.restartReminderTimer()
+		if err != nil {
+			fmt.Println("reload:", u.userID, err)
+		}
+	}
+
+	return cmdReply{fmt.Sprintf("Reloaded %d calendars", calendars), ""}
+}
+
+var usageAdminBroadcast = helpCommand{
+	"broadcast {message}",
+	"Send the message to all users and group rooms",
+	"broadcast The bot will be down for maintenance tonight",
+}
+
+var helpAdmin = helpSection{
+	"Admin commands",
+	[]helpCommand{
+		{"stats", "View the number of users, calendars and undelivered messages", ""},
+		{"users", "List all users and group rooms", ""},
+		{"user {id} calendars", "List the calendars of the user", ""},
+		{"user {id} disable", "Ignore the user and stop their reminders", ""},
+		{"user {id} enable", "Undo disabling the user", ""},
+		usageAdminBroadcast,
+		{"reload", "Fetch all calendars again", ""},
+	},
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"maunium.net/go/mautrix/id"
+)
+
+func TestIsAdmin(t *testing.T) {
+	admins := []string{"@operator:example.org"}
+
+	assertEqual(t, isAdmin(admins, "@operator:example.org"), true, "admin is recognised")
+	assertEqual(t, isAdmin(admins, "@alice:example.org"), false, "other users aren't admins")
+	assertEqual(t, isAdmin(nil, "@operator:example.org"), false, "nobody is admin without admins")
+}
+
+func TestRunAdminCommand(t *testing.T) {
+	data := newDataStore(nil)
+	data.users["@alice:example.org"] = &user{
+		userID:     "@alice:example.org",
+		existsInDB: true,
+		calendars: []*userCalendar{
+			{Name: "work", CalType: calendarTypeICal, RoomID: "!team:example.org"},
+		},
+	}
+	data.users["@bob:example.org"] = &user{userID: "@bob:example.org", existsInDB: true, disabled: true}
+
+	var tests = []struct {
+		body   string
+		expect string
+	}{
+		{"users", "* @alice:example.org (1 calendars)\n* @bob:example.org (0 calendars, disabled)"},
+		{"user @alice:example.org calendars", "* work (ical, room: !team:example.org)"},
+		{"user @bob:example.org calendars", "@bob:example.org has no calendars"},
+		{"user @carol:example.org calendars", "Unknown user: @carol:example.org"},
+	}
+
+	for _, test := range tests {
+		reply, err := runAdminCommand(data, test.body, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, reply.msg, test.expect, "reply to "+test.body)
+	}
+
+	assertEqual(t, data.knownUser(id.UserID("@carol:example.org")) == nil, true, "unknown user isn't created")
+
+	data.users["@alice:example.org"].calendars[0].Name = "<b>work</b>"
+	reply, err := runAdminCommand(data, "user @alice:example.org calendars", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, reply.msgF, "&nbsp;&#9702; <b>&lt;b&gt;work&lt;/b&gt;</b> (ical, room: !team:example.org)", "calendar names are escaped")
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// eventHandlers maps event types to the function handling them.
+type eventHandlers map[string]mautrix.EventHandler
+
+// generateRegistration writes the registration file to add to the
+// configuration of the homeserver, generating the tokens of the appservice
+// if they aren't configured yet.
+func generateRegistration(cfg *configMatrixBot, filename string) error {
+	var err error
+	if cfg.Appservice.ASToken == "" {
+		cfg.Appservice.ASToken, err = randomToken()
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.Appservice.HSToken == "" {
+		cfg.Appservice.HSToken, err = randomToken()
+		if err != nil {
+			return err
+		}
+	}
+
+	return ioutil.WriteFile(filename, []byte(formatRegistration(*cfg)), 0600)
+}
+
+// formatRegistration formats the appservice registration as YAML.
+func formatRegistration(cfg configMatrixBot) string {
+	as := cfg.Appservice
+
+	users := as.Namespaces.Users
+	if len(users) == 0 {
+		users = []configNamespace{{"^" + regexp.QuoteMeta(cfg.AccountID) + "$", true}}
+	}
+
+	lines := []string{
+		"id: " + yamlQuote(as.ID),
+		"url: " + yamlQuote(as.URL),
+		"as_token: " + yamlQuote(as.ASToken),
+		"hs_token: " + yamlQuote(as.HSToken),
+		"sender_localpart: " + yamlQuote(localpart(id.UserID(cfg.AccountID))),
+		"rate_limited: false",
+		"namespaces:",
+	}
+
+	for _, ns := range []struct {
+		name       string
+		namespaces []configNamespace
+	}{{"users", users}, {"aliases", as.Namespaces.Aliases}, {"rooms", as.Namespaces.Rooms}} {
+		if len(ns.namespaces) == 0 {
+			lines = append(lines, "  "+ns.name+": []")
+			continue
+		}
+
+		lines = append(lines, "  "+ns.name+":")
+		for _, n := range ns.namespaces {
+			lines = append(lines,
+				"    - regex: "+yamlQuote(n.Regex),
+				fmt.Sprintf("      exclusive: %t", n.Exclusive))
+		}
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// yamlQuote quotes the string as a single-quoted YAML scalar.
+func yamlQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// serveAppservice listens for the transactions the homeserver pushes events
+// with, passing the events to the handlers.
+func serveAppservice(cfg configAppservice, handlers eventHandlers) error {
+	l, err := net.Listen("tcp", cfg.ListenAddress)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Listening for appservice transactions on", cfg.ListenAddress)
+
+	go func() {
+		err := http.Serve(l, newAppserviceServer(cfg.HSToken, handlers))
+		fmt.Println("Appservice server stopped:", err)
+	}()
+
+	return nil
+}
+
+// appserviceServer implements the transaction endpoint of the application
+// service API. Other endpoints aren't needed, as the bot doesn't provide
+// users or rooms on demand.
+type appserviceServer struct {
+	hsToken  string
+	handlers eventHandlers
+
+	mutex sync.Mutex
+	// seen contains the IDs of recent transactions, which the homeserver
+	// retries when it didn't get the response.
+	seen    map[string]struct{}
+	seenIDs []string
+}
+
+const maxSeenTransactions = 100
+
+func newAppserviceServer(hsToken string, handlers eventHandlers) *appserviceServer {
+	return &appserviceServer{
+		hsToken:  hsToken,
+		handlers: handlers,
+		seen:     make(map[string]struct{}),
+	}
+}
+
+func (a *appserviceServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	txnID := ""
+	for _, prefix := range []string{"/_matrix/app/v1/transactions/", "/transactions/"} {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			txnID = strings.TrimPrefix(r.URL.Path, prefix)
+		}
+	}
+	if txnID == "" || r.Method != http.MethodPut {
+		writeAppserviceError(w, http.StatusNotFound, "M_NOT_FOUND", "Unknown endpoint")
+		return
+	}
+
+	token := r.URL.Query().Get("access_token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if token == "" {
+		writeAppserviceError(w, http.StatusUnauthorized, "M_UNAUTHORIZED", "Missing token")
+		return
+	}
+	if token != a.hsToken {
+		writeAppserviceError(w, http.StatusForbidden, "M_FORBIDDEN", "Invalid token")
+		return
+	}
+
+	var txn struct {
+		Events []*event.Event `json:"events"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&txn)
+	if err != nil {
+		writeAppserviceError(w, http.StatusBadRequest, "M_NOT_JSON", "Invalid transaction")
+		return
+	}
+
+	if a.markSeen(txnID) {
+		for _, ev := range txn.Events {
+			a.handleEvent(ev)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte("{}"))
+}
+
+// markSeen records the transaction, returning whether it's new.
+func (a *appserviceServer) markSeen(txnID string) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if _, ok := a.seen[txnID]; ok {
+		return false
+	}
+
+	a.seen[txnID] = struct{}{}
+	a.seenIDs = append(a.seenIDs, txnID)
+	if len(a.seenIDs) > maxSeenTransactions {
+		delete(a.seen, a.seenIDs[0])
+		a.seenIDs = a.seenIDs[1:]
+	}
+
+	return true
+}
+
+func (a *appserviceServer) handleEvent(ev *event.Event) {
+	handler, ok := a.handlers[ev.Type.Type]
+	if !ok {
+		return
+	}
+
+	if ev.StateKey != nil {
+		ev.Type.Class = event.StateEventType
+	} else {
+		ev.Type.Class = event.MessageEventType
+	}
+
+	err := ev.Content.ParseRaw(ev.Type)
+	if err != nil {
+		fmt.Println("parse event:", ev.ID, err)
+		return
+	}
+
+	handler(mautrix.EventSourceTimeline, ev)
+}
+
+func writeAppserviceError(w http.ResponseWriter, status int, errCode, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"errcode": errCode, "error": message})
+}
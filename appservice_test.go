@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestAppserviceTransactions(t *testing.T) {
+	bodies := []string{}
+	handlers := eventHandlers{
+		event.EventMessage.Type: func(_ mautrix.EventSource, ev *event.Event) {
+			bodies = append(bodies, ev.Content.AsMessage().Body)
+		},
+	}
+	server := newAppserviceServer("secret", handlers)
+
+	txn := `{"events": [
+		{"type": "m.room.message", "room_id": "!a:example.org", "sender": "@alice:example.org", "content": {"msgtype": "m.text", "body": "week"}},
+		{"type": "m.room.topic", "state_key": "", "room_id": "!a:example.org", "sender": "@alice:example.org", "content": {"topic": "plans"}}
+	]}`
+
+	var tests = []struct {
+		method, path, token string
+
+		expectStatus int
+		expectBodies int
+	}{
+		{"PUT", "/_matrix/app/v1/transactions/1", "secret", http.StatusOK, 1},
+		{"PUT", "/_matrix/app/v1/transactions/1", "secret", http.StatusOK, 1},
+		{"PUT", "/transactions/2", "secret", http.StatusOK, 2},
+		{"PUT", "/_matrix/app/v1/transactions/3", "wrong", http.StatusForbidden, 2},
+		{"PUT", "/_matrix/app/v1/transactions/4", "", http.StatusUnauthorized, 2},
+		{"GET", "/_matrix/app/v1/users/@bob:example.org", "secret", http.StatusNotFound, 2},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.path, strings.NewReader(txn))
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+
+		assertEqual(t, rec.Code, test.expectStatus, "status of "+test.method+" "+test.path)
+		assertEqual(t, len(bodies), test.expectBodies, "events are handled once for "+test.path)
+	}
+
+	assertEqual(t, bodies[0], "week", "message is parsed")
+}
+
+func TestFormatRegistration(t *testing.T) {
+	cfg := configMatrixBot{
+		AccountID: "@calendarbot:example.org",
+		Appservice: configAppservice{
+			ID:      "calendarbot",
+			URL:     "http://localhost:8009",
+			ASToken: "as",
+			HSToken: "hs",
+		},
+	}
+
+	expect := `id: 'calendarbot'
+url: 'http://localhost:8009'
+as_token: 'as'
+hs_token: 'hs'
+sender_localpart: 'calendarbot'
+rate_limited: false
+namespaces:
+  users:
+    - regex: '^@calendarbot:example\.org$'
+      exclusive: true
+  aliases: []
+  rooms: []
+`
+	assertEqual(t, formatRegistration(cfg), expect, "registration is formatted")
+}
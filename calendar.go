@@ -4,6 +4,8 @@ import (
 	"errors"
 	"net/http"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -25,6 +27,58 @@ type calendarEvent struct {
 	from, to time.Time
 
 	text string
+
+	location    string
+	description string
+
+	// calendar is the name the user gave the calendar of the event.
+	calendar string
+
+	// uid and occurrence identify the event across fetches, even if it's moved.
+	// occurrence identifies an instance of a recurring event.
+	uid        string
+	occurrence string
+}
+
+// id identifies the event across fetches of its calendar. Events without UID
+// are identified by their key.
+func (ev *calendarEvent) id() string {
+	if ev.uid == "" {
+		return ev.key()
+	}
+	return ev.uid + "/" + ev.occurrence
+}
+
+// formatOccurrence formats the (original) start of an instance of a recurring
+// event, for use as calendarEvent.occurrence.
+func formatOccurrence(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// parseRecurrenceID parses the value of an ical RECURRENCE-ID property.
+// Values without time zone are taken to be in loc.
+func parseRecurrenceID(rid string, loc *time.Location) (time.Time, error) {
+	if strings.HasSuffix(rid, "Z") {
+		return time.Parse("20060102T150405Z", rid)
+	}
+	if len(rid) == len("20060102") {
+		return time.ParseInLocation("20060102", rid, loc)
+	}
+	return time.ParseInLocation("20060102T150405", rid, loc)
+}
+
+// key identifies the occurrence of the event.
+func (ev *calendarEvent) key() string {
+	return strconv.FormatInt(ev.from.Unix(), 10) + " " + ev.text
+}
+
+// allDay reports whether the event spans one or more whole days.
+func (ev *calendarEvent) allDay() bool {
+	midnight := func(t time.Time) bool {
+		return t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0
+	}
+
+	return midnight(ev.from) && midnight(ev.to) && ev.to.After(ev.from)
 }
 
 // cachedCalendar wraps a calendar caching its events.
@@ -32,10 +86,18 @@ type cachedCalendar struct {
 	cal    calendar
 	period time.Duration
 
+	// name is set as the calendar of the fetched events.
+	name string
+
 	cache       calendarEvents
 	lastUpdated time.Time
 	cleanTimer  *time.Timer
 	mutex       sync.RWMutex
+
+	// onUpdate, if set, is called with the previous and the newly fetched
+	// events each time the cache is repopulated.
+	onUpdate func(previous, current calendarEvents)
+	previous calendarEvents
 }
 
 // newCachedCalendar wrapping the given calendar, caching its events for the given period.
@@ -60,6 +122,15 @@ func (cal *cachedCalendar) events() (calendarEvents, error) {
 
 		cal.lastUpdated = time.Now()
 
+		for _, ev := range cal.cache {
+			ev.calendar = cal.name
+		}
+
+		if cal.onUpdate != nil && cal.previous != nil {
+			go cal.onUpdate(cal.previous, cal.cache)
+		}
+		cal.previous = cal.cache
+
 		if cal.cleanTimer != nil {
 			cal.cleanTimer.Stop()
 		}
@@ -115,6 +186,15 @@ func (cal *calDavCalendar) events() (calendarEvents, error) {
 			from: ev.DateStart.NativeTime(),
 			to:   ev.DateEnd.NativeTime(),
 			text: ev.Summary,
+			uid:  ev.UID,
+
+			description: ev.Description,
+		}
+		if ev.Location != nil {
+			event.location = ev.Location.String()
+		}
+		if ev.RecurrenceId != nil {
+			event.occurrence = formatOccurrence(ev.RecurrenceId.NativeTime())
 		}
 
 		events = append(events, &event)
@@ -160,6 +240,21 @@ func (cal *iCalCalendar) events() (calendarEvents, error) {
 			from: start,
 			to:   end,
 			text: ev.Summary,
+			uid:  ev.Uid,
+
+			location:    ev.Location,
+			description: ev.Description,
+		}
+
+		// Moved instances of recurring events replace the instance starting
+		// at their RECURRENCE-ID.
+		if ev.RecurrenceID != "" {
+			rid, err := parseRecurrenceID(ev.RecurrenceID, start.Location())
+			if err == nil {
+				event.occurrence = formatOccurrence(rid)
+			}
+		} else if ev.IsRecurring {
+			event.occurrence = formatOccurrence(start)
 		}
 
 		events = append(events, &event)
@@ -234,6 +329,21 @@ func (c calendarEvents) between(from time.Time, until time.Time) calendarEvents
 	return events
 }
 
+// in gives copies of the events with their times in the given location.
+func (c calendarEvents) in(loc *time.Location) calendarEvents {
+	events := make([]*calendarEvent, 0, len(c))
+
+	for _, ev := range c {
+		evCp := *ev
+		evCp.from = evCp.from.In(loc)
+		evCp.to = evCp.to.In(loc)
+
+		events = append(events, &evCp)
+	}
+
+	return events
+}
+
 // formatsToDays converts the events into days, to ease printing a calendar.
 func (evs calendarEvents) formatToDays() []*eventDay {
 	days := []*eventDay{}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultChangesHorizon is how far ahead changes to events are notified by default.
+const defaultChangesHorizon = 48 * time.Hour
+
+type eventChangeKind int
+
+const (
+	eventAdded eventChangeKind = iota
+	eventMoved
+	eventCancelled
+)
+
+// eventChange is a difference between two fetches of a calendar.
+type eventChange struct {
+	kind eventChangeKind
+
+	// old is nil for added events, new is nil for cancelled events.
+	old, new *calendarEvent
+}
+
+// diffEvents gives the events which are added, moved or cancelled in current
+// compared to previous. Only changes involving events starting between from and
+// until are given.
+func diffEvents(previous, current calendarEvents, from, until time.Time) []eventChange {
+	inWindow := func(ev *calendarEvent) bool {
+		return !ev.from.Before(from) && !ev.from.After(until)
+	}
+
+	previousByID := make(map[string]*calendarEvent, len(previous))
+	for _, ev := range previous {
+		previousByID[ev.id()] = ev
+	}
+
+	changes := []eventChange{}
+	seen := make(map[string]bool, len(current))
+
+	for _, ev := range current {
+		seen[ev.id()] = true
+
+		old, ok := previousByID[ev.id()]
+		if !ok {
+			if inWindow(ev) {
+				changes = append(changes, eventChange{eventAdded, nil, ev})
+			}
+			continue
+		}
+
+		if old.from.Equal(ev.from) && old.to.Equal(ev.to) {
+			continue
+		}
+
+		if inWindow(old) || inWindow(ev) {
+			changes = append(changes, eventChange{eventMoved, old, ev})
+		}
+	}
+
+	for _, ev := range previous {
+		if seen[ev.id()] || !inWindow(ev) {
+			continue
+		}
+
+		changes = append(changes, eventChange{eventCancelled, ev, nil})
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].when().Before(changes[j].when())
+	})
+
+	return changes
+}
+
+// when gives the start of the event after the change, or before the change if
+// it's cancelled.
+func (c eventChange) when() time.Time {
+	if c.new != nil {
+		return c.new.from
+	}
+	return c.old.from
+}
+
+// changeSettings configures the notifications of changes in the calendars of a user.
+type changeSettings struct {
+	enabled bool
+	horizon time.Duration
+}
+
+func (u *user) setChangeSettings(cs changeSettings) error {
+	u.mutex.RLock()
+	userID := u.userID
+	u.mutex.RUnlock()
+
+	err := u.persist.updateUserChanges(userID, cs)
+	if err != nil {
+		return err
+	}
+
+	u.mutex.Lock()
+	u.changes = cs
+	u.mutex.Unlock()
+
+	return nil
+}
+
+func (u *user) changeSettings() changeSettings {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	return u.changes
+}
+
+// watchCalendar makes changes to the events of the calendar to be notified to
+// the user, and its reminders to be updated.
+func (u *user) watchCalendar(uc *userCalendar) {
+	uc.mutex.Lock()
+	defer uc.mutex.Unlock()
+
+	uc.onUpdate = func(previous, current calendarEvents) {
+		u.calendarUpdated(uc, previous, current)
+	}
+}
+
+func (u *user) calendarUpdated(uc *userCalendar, previous, current calendarEvents) {
+	cs := u.changeSettings()
+
+	now := time.Now()
+	changes := diffEvents(previous, current, now, now.Add(cs.horizon))
+	if len(changes) == 0 {
+		return
+	}
+
+	// The reminders could be set for the old times of the events.
+	err := u.restartReminderTimer()
+	if err != nil {
+		fmt.Println("restart reminder timer after changes:", u.userID, err)
+	}
+
+	if !cs.enabled || !uc.notifiesChanges() || u.messageSender() == nil {
+		return
+	}
+
+	reply := formatChanges(uc.Name, changes, u.location())
+
+	roomID := uc.room()
+	if roomID == "" {
+		roomID = u.RoomID()
+	}
+
+	_, err = u.messageSender().sendMessage(roomID, reply.msg, reply.msgF, true).wait()
+	if err != nil {
+		fmt.Println("changes:", u.userID, err)
+	}
+}
+
+func formatChanges(calName string, changes []eventChange, loc *time.Location) cmdReply {
+	const timeFormat = "Monday 2 January 15:04"
+
+	lines := []string{"Changes in your calendar " + calName}
+	linesF := []string{"<b>Changes in your calendar " + html.EscapeString(calName) + "</b>"}
+
+	for _, c := range changes {
+		switch c.kind {
+		case eventAdded:
+			when := c.new.from.In(loc).Format(timeFormat)
+			lines = append(lines, fmt.Sprintf("New: %s: %s", when, c.new.text))
+			linesF = append(linesF, fmt.Sprintf("<b>New</b>: <code>%s</code>: %s", when, html.EscapeString(c.new.text)))
+		case eventMoved:
+			from := c.old.from.In(loc).Format(timeFormat)
+			to := c.new.from.In(loc).Format(timeFormat)
+			lines = append(lines, fmt.Sprintf("Moved: %s: from %s to %s", c.new.text, from, to))
+			linesF = append(linesF, fmt.Sprintf("<b>Moved</b>: %s: from <code>%s</code> to <code>%s</code>", html.EscapeString(c.new.text), from, to))
+		case eventCancelled:
+			when := c.old.from.In(loc).Format(timeFormat)
+			lines = append(lines, fmt.Sprintf("Cancelled: %s: %s", when, c.old.text))
+			linesF = append(linesF, fmt.Sprintf("<b>Cancelled</b>: <code>%s</code>: <del>%s</del>", when, html.EscapeString(c.old.text)))
+		}
+	}
+
+	return cmdReply{strings.Join(lines, "\n"), strings.Join(linesF, "<br />")}
+}
+
+// parseHorizon parses durations like 48h and 3d.
+func parseHorizon(str string) (time.Duration, error) {
+	if strings.HasSuffix(str, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(str, "d"))
+		if err != nil || days <= 0 {
+			return 0, fmt.Errorf("invalid amount of days: %q", str)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+
+	d, err := time.ParseDuration(str)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("horizon should be positive")
+	}
+
+	return d, nil
+}
+
+func formatHorizon(d time.Duration) string {
+	if d%(24*time.Hour) == 0 {
+		days := int(d / (24 * time.Hour))
+		if days == 1 {
+			return "1 day"
+		}
+		return strconv.Itoa(days) + " days"
+	}
+
+	return formatHours(d)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDiffEventsFindsAddedMovedAndCancelledEvents(t *testing.T) {
+	now := time.Date(2020, 11, 9, 12, 0, 0, 0, time.Local)
+
+	unchanged := &calendarEvent{from: now.Add(time.Hour), to: now.Add(2 * time.Hour), text: "unchanged", uid: "1"}
+	moved := &calendarEvent{from: now.Add(3 * time.Hour), to: now.Add(4 * time.Hour), text: "moved", uid: "2"}
+	movedNew := &calendarEvent{from: now.Add(5 * time.Hour), to: now.Add(6 * time.Hour), text: "moved", uid: "2"}
+	cancelled := &calendarEvent{from: now.Add(7 * time.Hour), to: now.Add(8 * time.Hour), text: "cancelled", uid: "3"}
+	added := &calendarEvent{from: now.Add(2 * time.Hour), to: now.Add(3 * time.Hour), text: "added", uid: "4"}
+	farAway := &calendarEvent{from: now.Add(100 * time.Hour), to: now.Add(101 * time.Hour), text: "far away", uid: "5"}
+
+	previous := calendarEvents{unchanged, moved, cancelled}
+	current := calendarEvents{unchanged, added, movedNew, farAway}
+
+	changes := diffEvents(previous, current, now, now.Add(48*time.Hour))
+
+	if len(changes) != 3 {
+		t.Fatalf("received incorrect amount of changes, got: %d", len(changes))
+	}
+
+	assertEqual(t, changes[0].kind, eventAdded, "first change is an addition")
+	assertEqual(t, changes[0].new, added, "added event is correct")
+
+	assertEqual(t, changes[1].kind, eventMoved, "second change is a move")
+	assertEqual(t, changes[1].old, moved, "moved event has correct old event")
+	assertEqual(t, changes[1].new, movedNew, "moved event has correct new event")
+
+	assertEqual(t, changes[2].kind, eventCancelled, "third change is a cancellation")
+	assertEqual(t, changes[2].old, cancelled, "cancelled event is correct")
+}
+
+func TestDiffEventsIdentifiesOccurrencesOfRecurringEvents(t *testing.T) {
+	now := time.Date(2020, 11, 9, 12, 0, 0, 0, time.Local)
+
+	first := now.Add(time.Hour)
+	second := now.Add(25 * time.Hour)
+
+	previous := calendarEvents{
+		{from: first, to: first.Add(time.Hour), text: "standup", uid: "1", occurrence: formatOccurrence(first)},
+		{from: second, to: second.Add(time.Hour), text: "standup", uid: "1", occurrence: formatOccurrence(second)},
+	}
+	current := calendarEvents{
+		previous[0],
+		{from: second.Add(time.Hour), to: second.Add(2 * time.Hour), text: "standup", uid: "1", occurrence: formatOccurrence(second)},
+	}
+
+	changes := diffEvents(previous, current, now, now.Add(48*time.Hour))
+
+	if len(changes) != 1 {
+		t.Fatalf("received incorrect amount of changes, got: %d", len(changes))
+	}
+	assertEqual(t, changes[0].kind, eventMoved, "occurrence is moved")
+}
+
+func TestFormatChangesEscapesHTML(t *testing.T) {
+	now := time.Date(2020, 11, 9, 12, 0, 0, 0, time.UTC)
+	added := &calendarEvent{from: now, to: now.Add(time.Hour), text: "<i>Q&A</i>", uid: "1"}
+
+	reply := formatChanges("R&D", []eventChange{{kind: eventAdded, new: added}}, time.UTC)
+
+	assertEqual(t, reply.msg, "Changes in your calendar R&D\nNew: Monday 9 November 12:00: <i>Q&A</i>", "plain changes aren't escaped")
+	assertEqual(t, reply.msgF, "<b>Changes in your calendar R&amp;D</b><br /><b>New</b>: <code>Monday 9 November 12:00</code>: &lt;i&gt;Q&amp;A&lt;/i&gt;",
+		"calendar and event names are escaped in HTML")
+}
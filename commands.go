@@ -2,12 +2,14 @@ package main
 
 import (
 	"fmt"
+	"html"
 	"strconv"
 	"strings"
 	"time"
 
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
 )
 
 type cmdReply struct {
@@ -15,21 +17,28 @@ type cmdReply struct {
 	msgF string
 }
 
-func handleCommand(cli *mautrix.Client, data *store, ev *event.Event) (replies []cmdReply) {
+// handleCommand runs the command in the message, calling started once the
+// message turned out to be a command.
+func handleCommand(cli *mautrix.Client, data *store, commands commandMatcher, ev *event.Event, started func()) (replies []cmdReply) {
 	start := time.Now()
 	defer func() {
 		fmt.Println(time.Since(start))
 	}()
 
-	var err error
-
-	str := strings.TrimSpace(ev.Content.AsMessage().Body)
-	str = strings.ToLower(str)
+	if r := data.groupRoom(ev.RoomID); r != nil {
+		return handleGroupCommand(cli, commands, r, ev, started)
+	}
 
-	args := strings.Split(str, " ")
-	if len(args) < 0 {
-		return
+	body := ev.Content.AsMessage().Body
+	if !isDirectChat(data, ev.Sender, ev.RoomID) {
+		// Outside of direct chats, ordinary messages are ignored.
+		var ok bool
+		body, ok = commands.match(ev.Content.AsMessage())
+		if !ok {
+			return
+		}
 	}
+	started()
 
 	ud, err := data.user(ev.Sender)
 	if err != nil {
@@ -39,6 +48,10 @@ func handleCommand(cli *mautrix.Client, data *store, ev *event.Event) (replies [
 		return
 	}
 
+	if ud.isDisabled() {
+		return []cmdReply{{"Sorry, your account has been disabled by the operator of this bot", ""}}
+	}
+
 	if !ud.ExistsInDB() {
 		fmt.Println("Storing room")
 		err = ud.store(ev.RoomID)
@@ -46,12 +59,22 @@ func handleCommand(cli *mautrix.Client, data *store, ev *event.Event) (replies [
 			fmt.Println(err)
 			replies = append(replies, cmdReply{
 				"Oops, something went wrong", ""})
+		} else {
+			ud.startReminders()
 		}
 	}
-	if ev.RoomID != ud.roomID {
-		replies = append(replies, cmdReply{
-			"This is not the room we normally use. Please go to: " + string(ud.roomID), ""})
-	}
+	return append(replies, runCommand(cli, ud, ev.RoomID, body)...)
+}
+
+// runCommand runs the command for the user, or group room, ud.
+func runCommand(cli *mautrix.Client, ud *user, roomID id.RoomID, body string) (replies []cmdReply) {
+	var err error
+
+	str := strings.TrimSpace(body)
+	rawArgs := strings.Split(str, " ")
+	str = strings.ToLower(str)
+
+	args := strings.Split(str, " ")
 
 	var reply cmdReply
 	switch args[0] {
@@ -116,11 +139,39 @@ func handleCommand(cli *mautrix.Client, data *store, ev *event.Event) (replies [
 			reply = cmdCalendarList(ud)
 		case "remove":
 			reply, err = cmdCalendarRemove(ud, args)
+		case "room":
+			reply, err = cmdCalendarRoom(cli, ud, roomID, args, rawArgs)
 		default:
 			replies = append(replies, cmdReply{
 				"Unknown option", ""})
 			reply = formatHelp(helpCal)
 		}
+	case "timezone", "tz":
+		reply, err = cmdTimezone(ud, rawArgs)
+	case "digest":
+		reply, err = cmdDigest(ud, args)
+	case "weekly":
+		reply, err = cmdWeekly(ud, args)
+	case "reminders", "reminder":
+		reply, err = cmdReminders(ud, args, rawArgs)
+	case "quiet":
+		reply, err = cmdQuiet(ud, args)
+	case "pause":
+		reply, err = cmdPause(ud, args)
+	case "resume":
+		reply, err = cmdPause(ud, []string{"pause", "off"})
+	case "changes":
+		reply, err = cmdChanges(ud, args)
+	case "upcoming":
+		if len(args) < 2 || (args[1] != "reminders" && args[1] != "reminder") {
+			reply = formatUsage(usageUpcomingReminders)
+			break
+		}
+		reply = cmdUpcomingReminders(ud)
+	case "use":
+		reply, err = cmdUseRoom(ud, roomID, args)
+	case "rooms":
+		reply = cmdRooms(ud, roomID)
 	case "help", "?":
 		reply = formatAllHelp()
 	default:
@@ -147,12 +198,12 @@ func cmdListEvents(u *user, period string, year int, week int) (cmdReply, error)
 		return cmdReply{}, err
 	}
 
-	now := time.Now()
+	loc := u.location()
+
+	now := time.Now().In(loc)
 	from := time.Time{}
 	to := time.Time{}
 
-	loc := now.Location() // TODO: loc should be depending on user.
-
 	daysFromToTo := 7
 	switch period {
 	case "today":
@@ -186,20 +237,30 @@ func cmdListEvents(u *user, period string, year int, week int) (cmdReply, error)
 		return cmdReply{}, err
 	}
 
+	weekNum := 0
+	if strings.Contains(period, "week") {
+		_, weekNum = from.ISOWeek()
+	}
+
+	return formatEvents(events, to, loc, weekNum), nil
+}
+
+// formatEvents lists the events per day, up to the given time. A week number
+// other than 0 is shown as header.
+func formatEvents(events calendarEvents, to time.Time, loc *time.Location, week int) cmdReply {
 	// TODO: Properly handle multi-day events.
 
 	lines := []string{}
 	linesF := []string{}
 
-	if strings.Contains(period, "week") {
-		_, week := from.ISOWeek()
+	if week != 0 {
 		wk := strconv.Itoa(week)
 
 		lines = append(lines, "Week "+wk, "")
 		linesF = append(linesF, "<b>Week "+wk+"</b>", "")
 	}
 
-	days := events.formatToDays()
+	days := events.in(loc).formatToDays()
 	for i, day := range days {
 		if to.Before(day.day) {
 			continue
@@ -220,7 +281,7 @@ func cmdListEvents(u *user, period string, year int, week int) (cmdReply, error)
 		}
 	}
 
-	return cmdReply{strings.Join(lines, "\n"), strings.Join(linesF, "<br />")}, nil
+	return cmdReply{strings.Join(lines, "\n"), strings.Join(linesF, "<br />")}
 }
 
 func timeStartOfToday(base time.Time, loc *time.Location) time.Time {
@@ -228,7 +289,9 @@ func timeStartOfToday(base time.Time, loc *time.Location) time.Time {
 }
 
 func timeStartOfWeek(base time.Time, loc *time.Location) time.Time {
-	return time.Date(base.Year(), base.Month(), base.Day()-int(base.Weekday())+1, 0, 0, 0, 0, loc)
+	// Weeks start on Monday, while time.Weekday starts counting on Sunday.
+	daysSinceMonday := (int(base.Weekday()) + 6) % 7
+	return time.Date(base.Year(), base.Month(), base.Day()-daysSinceMonday, 0, 0, 0, 0, loc)
 }
 
 func timeStartOfYearPlusWeeks(year int, loc *time.Location, weekNumber int) time.Time {
@@ -259,7 +322,63 @@ func cmdCalendarRemove(u *user, args []string) (cmdReply, error) {
 		return cmdReply{}, err
 	}
 	return cmdReply{"Calendar " + name + " removed",
-		"Calendar <b>" + name + "</b> removed"}, nil
+		"Calendar <b>" + name + "</b> removed"}, u.restartReminderTimer()
+}
+
+func cmdCalendarRoom(cli *mautrix.Client, u *user, currentRoom id.RoomID, args []string, rawArgs []string) (cmdReply, error) {
+	if len(args) < 3 {
+		return formatUsage(usageCalRoom), nil
+	}
+
+	name := strings.ToLower(args[2])
+	uc := u.calendar(name)
+	if uc == nil {
+		return cmdReply{
+			"There is no calendar named " + name,
+			"There is no calendar named <b>" + name + "</b>"}, nil
+	}
+
+	if len(args) < 4 {
+		roomID := uc.room()
+		if roomID == "" {
+			return cmdReply{
+				"Reminders for calendar " + name + " are sent to this room",
+				"Reminders for calendar <b>" + name + "</b> are sent to this room"}, nil
+		}
+		return cmdReply{
+			"Reminders for calendar " + name + " are sent to " + string(roomID),
+			"Reminders for calendar <b>" + name + "</b> are sent to <code>" + string(roomID) + "</code>"}, nil
+	}
+
+	var roomID id.RoomID
+	switch args[3] {
+	case "reset":
+		return cmdReply{
+			"Reminders for calendar " + name + " are sent to your own room again",
+			"Reminders for calendar <b>" + name + "</b> are sent to your own room again"}, uc.setRoom(u.persist, "")
+	case "here":
+		roomID = currentRoom
+	default:
+		roomID = id.RoomID(rawArgs[3])
+		if !strings.HasPrefix(string(roomID), "!") {
+			return formatUsage(usageCalRoom), nil
+		}
+	}
+
+	botJoined, userJoined, err := roomMembership(cli, roomID, u.userID)
+	if err != nil {
+		return cmdReply{}, err
+	}
+	if !botJoined {
+		return cmdReply{"I'm not in that room, please invite me first", ""}, nil
+	}
+	if !userJoined {
+		return cmdReply{"You're not in that room, so reminders can't be sent there", ""}, nil
+	}
+
+	return cmdReply{
+		"Reminders for calendar " + name + " will be sent to " + string(roomID),
+		"Reminders for calendar <b>" + name + "</b> will be sent to <code>" + string(roomID) + "</code>"}, uc.setRoom(u.persist, roomID)
 }
 
 var replyNoCalendars = cmdReply{"You haven't configured any calendars. Use the 'cal add' command to start.", ""}
@@ -299,6 +418,11 @@ func cmdCalendarList(u *user) cmdReply {
 
 		linesF = append(linesF, fmt.Sprintf("<b>%s</b>", uc.Name))
 		linesF = append(linesF, "type: "+string(uc.CalType))
+
+		if roomID := uc.room(); roomID != "" {
+			lines = append(lines, "room: "+string(roomID))
+			linesF = append(linesF, "room: <code>"+string(roomID)+"</code>")
+		}
 	}
 	u.calendarsMutex.RUnlock()
 
@@ -343,7 +467,586 @@ func cmdCalendarAdd(u *user, args []string) (cmdReply, error) {
 		return cmdReply{"Invalid calendar type specified. Supported types are 'caldav' and 'ical'.", ""}, nil
 	}
 
-	return cmdReply{"Calendar added", ""}, u.addCalendar(name, calType, uri)
+	err := u.addCalendar(name, calType, uri)
+	if err != nil {
+		return cmdReply{}, err
+	}
+
+	return cmdReply{"Calendar added", ""}, u.restartReminderTimer()
+}
+
+func cmdTimezone(u *user, args []string) (cmdReply, error) {
+	if len(args) < 2 {
+		u.mutex.RLock()
+		timezone := u.timezone
+		u.mutex.RUnlock()
+
+		if timezone == "" {
+			return cmdReply{
+				"You haven't set a timezone, " + time.Local.String() + " is used",
+				"You haven't set a timezone, <b>" + time.Local.String() + "</b> is used"}, nil
+		}
+		return cmdReply{
+			"Your timezone is " + timezone,
+			"Your timezone is <b>" + timezone + "</b>"}, nil
+	}
+
+	timezone := args[1]
+
+	_, err := time.LoadLocation(timezone)
+	if err != nil {
+		return cmdReply{"Unknown timezone " + timezone + ". Use a name like Europe/Amsterdam", ""}, nil
+	}
+
+	err = u.setTimezone(timezone)
+	if err != nil {
+		return cmdReply{}, err
+	}
+
+	// The digest is scheduled according to the timezone.
+	u.restartDigestTimer()
+	u.restartWeeklyTimers()
+
+	return cmdReply{
+		"Timezone set to " + timezone,
+		"Timezone set to <b>" + timezone + "</b>"}, nil
+}
+
+func cmdDigest(u *user, args []string) (cmdReply, error) {
+	if len(args) < 2 {
+		ds := u.digestSettings()
+		if !ds.enabled {
+			return cmdReply{"You don't receive a daily digest", ""}, nil
+		}
+
+		msg := "You receive a daily digest at " + ds.at.String()
+		msgF := "You receive a daily digest at <b>" + ds.at.String() + "</b>"
+		if ds.skipEmpty {
+			msg += ", except on days without events"
+			msgF += ", except on days without events"
+		}
+		return cmdReply{msg, msgF}, nil
+	}
+
+	switch args[1] {
+	case "off", "stop":
+		return cmdReply{"You will no longer receive a daily digest", ""},
+			u.setDigest(digestSettings{})
+	case "daily":
+		if len(args) < 3 {
+			return formatUsage(usageDigest), nil
+		}
+
+		at, err := parseTimeOfDay(args[2])
+		if err != nil {
+			return cmdReply{"Invalid time specified, use a time like 07:30", ""}, nil
+		}
+
+		ds := digestSettings{enabled: true, at: at}
+		if len(args) >= 4 {
+			if args[3] != "skipempty" {
+				return formatUsage(usageDigest), nil
+			}
+			ds.skipEmpty = true
+		}
+
+		return cmdReply{
+			"You will receive your agenda every day at " + at.String(),
+			"You will receive your agenda every day at <b>" + at.String() + "</b>"}, u.setDigest(ds)
+	}
+
+	return formatUsage(usageDigest), nil
+}
+
+func cmdWeekly(u *user, args []string) (cmdReply, error) {
+	preview, review := u.weeklySettings()
+
+	if len(args) < 2 {
+		lines := []string{}
+		linesF := []string{}
+
+		if preview.enabled {
+			lines = append(lines, "You receive a preview of next week every "+preview.String())
+			linesF = append(linesF, "You receive a preview of next week every <b>"+preview.String()+"</b>")
+		} else {
+			lines = append(lines, "You don't receive a weekly preview")
+			linesF = append(linesF, "You don't receive a weekly preview")
+		}
+
+		if review.enabled {
+			lines = append(lines, "You receive a review of this week every "+review.String())
+			linesF = append(linesF, "You receive a review of this week every <b>"+review.String()+"</b>")
+		} else {
+			lines = append(lines, "You don't receive a weekly review")
+			linesF = append(linesF, "You don't receive a weekly review")
+		}
+
+		return cmdReply{strings.Join(lines, "\n"), strings.Join(linesF, "<br />")}, nil
+	}
+
+	var setting *weeklyTime
+	var name string
+	switch args[1] {
+	case "preview":
+		setting = &preview
+		name = "preview of next week"
+		if len(args) == 2 {
+			preview = defaultWeeklyPreview
+		}
+	case "review":
+		setting = &review
+		name = "review of this week"
+		if len(args) == 2 {
+			review = defaultWeeklyReview
+		}
+	default:
+		return formatUsage(usageWeekly), nil
+	}
+
+	if len(args) == 3 {
+		if args[2] != "off" && args[2] != "stop" {
+			return formatUsage(usageWeekly), nil
+		}
+
+		*setting = weeklyTime{}
+		return cmdReply{"You will no longer receive a weekly " + args[1], ""},
+			u.setWeekly(preview, review)
+	}
+
+	if len(args) >= 4 {
+		w, err := parseWeeklyTime(args[2] + " " + args[3])
+		if err != nil {
+			return cmdReply{"Invalid day or time specified, use something like: sunday 19:00", ""}, nil
+		}
+		*setting = w
+	}
+
+	return cmdReply{
+		"You will receive a " + name + " every " + setting.String(),
+		"You will receive a " + name + " every <b>" + setting.String() + "</b>"}, u.setWeekly(preview, review)
+}
+
+func cmdReminders(u *user, args []string, rawArgs []string) (cmdReply, error) {
+	if len(args) < 2 {
+		return formatReminderSettings(u), nil
+	}
+
+	switch args[1] {
+	case "repeat":
+		return cmdRemindersRepeat(u, args)
+	case "end":
+		return cmdRemindersEnd(u, args)
+	case "allday":
+		return cmdRemindersAllDay(u, args)
+	case "template":
+		return cmdRemindersTemplate(u, args, rawArgs)
+	case "ended":
+		return cmdRemindersEnded(u, args)
+	}
+
+	return formatHelp(helpReminders), nil
+}
+
+func formatReminderSettings(u *user) cmdReply {
+	lines := []string{}
+
+	if u.repeatsReminders() {
+		lines = append(lines, "You are reminded again at the start of events, unless you acknowledged an earlier reminder")
+	} else {
+		lines = append(lines, "You are not reminded again at the start of events you were already reminded of")
+	}
+
+	endReminders, allDay := u.reminderTimes()
+	if len(endReminders) > 0 {
+		lines = append(lines, "You are reminded "+formatMinutesList(endReminders)+" minutes before the end of events")
+	}
+	if allDay.enabled {
+		day := "on the day"
+		if allDay.dayBefore {
+			day = "the day before"
+		}
+		lines = append(lines, "All-day events are announced at "+allDay.at.String()+" "+day)
+	}
+
+	switch u.reminderEndedAction() {
+	case reminderEndedEdit:
+		lines = append(lines, "Reminders are changed to say the event ended")
+	case reminderEndedRedact:
+		lines = append(lines, "Reminders are removed after the event ended")
+	}
+
+	return cmdReply{strings.Join(lines, "\n"), strings.Join(lines, "<br />")}
+}
+
+func cmdUpcomingReminders(u *user) cmdReply {
+	timer := u.activeReminderTimer()
+	if timer == nil {
+		return cmdReply{"Your reminders haven't been scheduled yet, try again in a moment", ""}
+	}
+
+	loc := u.location()
+	rems := timer.upcoming()
+
+	lines := []string{}
+	linesF := []string{}
+
+	for _, rem := range rems {
+		if u.reminders.isAcknowledged(rem.event) {
+			continue
+		}
+
+		when := rem.when.In(loc).Format("Monday 2 January 15:04")
+		calName := ""
+		if rem.event.calendar != "" {
+			calName = " (" + rem.event.calendar + ")"
+		}
+
+		lines = append(lines, fmt.Sprintf("%s: %q %s%s", when, rem.event.text, rem.describe(rem.when), calName))
+		linesF = append(linesF, fmt.Sprintf("<code>%s</code>: <b>%s</b> %s%s",
+			when, html.EscapeString(rem.event.text), rem.describe(rem.when), html.EscapeString(calName)))
+	}
+
+	if len(lines) == 0 {
+		return cmdReply{"There are no reminders scheduled at the moment", ""}
+	}
+
+	lines = append([]string{"Upcoming reminders"}, lines...)
+	linesF = append([]string{"<b>Upcoming reminders</b>"}, linesF...)
+
+	return cmdReply{strings.Join(lines, "\n"), strings.Join(linesF, "<br />")}
+}
+
+func cmdRemindersRepeat(u *user, args []string) (cmdReply, error) {
+	if len(args) < 3 {
+		return formatUsage(usageRemindersRepeat), nil
+	}
+
+	switch args[2] {
+	case "on":
+		return cmdReply{"You will be reminded again at the start of events, unless you acknowledge the earlier reminder", ""},
+			u.setReminderRepeat(true)
+	case "off":
+		return cmdReply{"You will only be reminded once for each event", ""},
+			u.setReminderRepeat(false)
+	}
+
+	return formatUsage(usageRemindersRepeat), nil
+}
+
+func cmdRemindersEnd(u *user, args []string) (cmdReply, error) {
+	if len(args) < 3 {
+		return formatUsage(usageRemindersEnd), nil
+	}
+
+	_, allDay := u.reminderTimes()
+
+	if args[2] == "off" {
+		return cmdReply{"You will no longer be reminded of the end of events", ""},
+			u.setReminderTimes(nil, allDay)
+	}
+
+	endReminders, err := parseMinutesList(strings.Join(args[2:], ","))
+	if err != nil {
+		return formatUsage(usageRemindersEnd), nil
+	}
+
+	return cmdReply{"You will be reminded " + formatMinutesList(endReminders) + " minutes before the end of events", ""},
+		u.setReminderTimes(endReminders, allDay)
+}
+
+func cmdRemindersAllDay(u *user, args []string) (cmdReply, error) {
+	if len(args) < 3 {
+		return formatUsage(usageRemindersAllDay), nil
+	}
+
+	endReminders, _ := u.reminderTimes()
+
+	if args[2] == "reset" {
+		return cmdReply{"You will be reminded of all-day events like of other events", ""},
+			u.setReminderTimes(endReminders, allDayReminder{})
+	}
+
+	at, err := parseTimeOfDay(args[2])
+	if err != nil {
+		return cmdReply{"Invalid time specified, use a time like 08:00", ""}, nil
+	}
+
+	allDay := allDayReminder{enabled: true, at: at}
+	if len(args) >= 4 {
+		if args[3] != "daybefore" {
+			return formatUsage(usageRemindersAllDay), nil
+		}
+		allDay.dayBefore = true
+	}
+
+	day := "on the day itself"
+	if allDay.dayBefore {
+		day = "the day before"
+	}
+
+	return cmdReply{
+		"All-day events will be announced at " + at.String() + " " + day,
+		"All-day events will be announced at <b>" + at.String() + "</b> " + day}, u.setReminderTimes(endReminders, allDay)
+}
+
+func cmdRemindersEnded(u *user, args []string) (cmdReply, error) {
+	if len(args) < 3 {
+		return formatUsage(usageRemindersEnded), nil
+	}
+
+	switch args[2] {
+	case "keep":
+		return cmdReply{"Reminders are kept as they are after the event ended", ""},
+			u.setReminderEndedAction(reminderEndedKeep)
+	case "edit":
+		return cmdReply{"Reminders will be changed to say the event ended", ""},
+			u.setReminderEndedAction(reminderEndedEdit)
+	case "redact", "remove":
+		return cmdReply{"Reminders will be removed after the event ended", ""},
+			u.setReminderEndedAction(reminderEndedRedact)
+	}
+
+	return formatUsage(usageRemindersEnded), nil
+}
+
+func cmdRemindersTemplate(u *user, args []string, rawArgs []string) (cmdReply, error) {
+	tmpl := u.reminderTemplate()
+
+	if len(args) < 3 {
+		plainT, htmlT := tmpl.plain, tmpl.html
+		if plainT == "" {
+			plainT = defaultReminderTemplate
+		}
+		if htmlT == "" {
+			htmlT = defaultReminderTemplateHTML
+		}
+
+		return cmdReply{
+			"Your reminder template is: " + plainT + "\nAnd in HTML: " + htmlT,
+			"Your reminder template is: <code>" + html.EscapeString(plainT) + "</code><br />And in HTML: <code>" + html.EscapeString(htmlT) + "</code>"}, nil
+	}
+
+	if args[2] == "reset" {
+		return cmdReply{"Your reminders use the default template again", ""},
+			u.setReminderTemplate(reminderTemplate{})
+	}
+
+	if args[2] == "html" {
+		if len(args) < 4 {
+			return formatUsage(usageRemindersTemplateHTML), nil
+		}
+		tmpl.html = strings.Join(rawArgs[3:], " ")
+	} else {
+		tmpl.plain = strings.Join(rawArgs[2:], " ")
+	}
+
+	err := tmpl.validate()
+	if err != nil {
+		return cmdReply{"Invalid template: " + err.Error(), ""}, nil
+	}
+
+	return cmdReply{"Your reminder template is updated", ""}, u.setReminderTemplate(tmpl)
+}
+
+func cmdQuiet(u *user, args []string) (cmdReply, error) {
+	qs := u.quietSettings()
+
+	if len(args) < 2 {
+		lines := []string{}
+		linesF := []string{}
+
+		if qs.enabled {
+			lines = append(lines, "Your quiet hours are from "+qs.from.String()+" until "+qs.to.String())
+			linesF = append(linesF, "Your quiet hours are from <b>"+qs.from.String()+"</b> until <b>"+qs.to.String()+"</b>")
+		} else {
+			lines = append(lines, "You haven't set quiet hours")
+			linesF = append(linesF, "You haven't set quiet hours")
+		}
+
+		if qs.pausedUntil.After(time.Now()) {
+			until := qs.pausedUntil.In(u.location()).Format("Monday 2 January 15:04")
+			lines = append(lines, "Reminders are paused until "+until)
+			linesF = append(linesF, "Reminders are paused until <b>"+until+"</b>")
+		}
+
+		if qs.batch {
+			lines = append(lines, "Reminders during quiet times are sent to you afterwards")
+			linesF = append(linesF, "Reminders during quiet times are sent to you afterwards")
+		} else {
+			lines = append(lines, "Reminders during quiet times are dropped")
+			linesF = append(linesF, "Reminders during quiet times are dropped")
+		}
+
+		return cmdReply{strings.Join(lines, "\n"), strings.Join(linesF, "<br />")}, nil
+	}
+
+	switch args[1] {
+	case "off":
+		qs.enabled = false
+		return cmdReply{"Quiet hours disabled", ""}, u.setQuiet(qs)
+	case "batch":
+		qs.batch = true
+		return cmdReply{"Reminders during quiet times will be sent to you in one message afterwards", ""}, u.setQuiet(qs)
+	case "drop", "suppress":
+		qs.batch = false
+		return cmdReply{"Reminders during quiet times will be dropped", ""}, u.setQuiet(qs)
+	}
+
+	if len(args) < 3 {
+		return formatUsage(usageQuiet), nil
+	}
+
+	from, err := parseTimeOfDay(args[1])
+	if err != nil {
+		return cmdReply{"Invalid time specified, use a time like 22:00", ""}, nil
+	}
+	to, err := parseTimeOfDay(args[2])
+	if err != nil {
+		return cmdReply{"Invalid time specified, use a time like 07:00", ""}, nil
+	}
+	if from == to {
+		return cmdReply{"The start and end of your quiet hours can't be the same", ""}, nil
+	}
+
+	qs.enabled = true
+	qs.from = from
+	qs.to = to
+
+	return cmdReply{
+		"You won't receive reminders from " + from.String() + " until " + to.String(),
+		"You won't receive reminders from <b>" + from.String() + "</b> until <b>" + to.String() + "</b>"}, u.setQuiet(qs)
+}
+
+func cmdPause(u *user, args []string) (cmdReply, error) {
+	qs := u.quietSettings()
+
+	if len(args) < 2 {
+		return formatUsage(usagePause), nil
+	}
+
+	if args[1] == "off" {
+		qs.pausedUntil = time.Time{}
+		return cmdReply{"Reminders resumed", ""}, u.setQuiet(qs)
+	}
+
+	dateStr := args[1]
+	if args[1] == "until" {
+		if len(args) < 3 {
+			return formatUsage(usagePause), nil
+		}
+		dateStr = args[2]
+	}
+
+	loc := u.location()
+	until, err := time.ParseInLocation("2006-01-02", dateStr, loc)
+	if err != nil {
+		return cmdReply{"Invalid date specified, use a date like 2020-12-31", ""}, nil
+	}
+	if !until.After(time.Now()) {
+		return cmdReply{"That date has already started", ""}, nil
+	}
+
+	qs.pausedUntil = until
+
+	header := until.Format("Monday 2 January")
+	return cmdReply{
+		"Reminders are paused, they will resume on " + header,
+		"Reminders are paused, they will resume on <b>" + header + "</b>"}, u.setQuiet(qs)
+}
+
+func cmdChanges(u *user, args []string) (cmdReply, error) {
+	cs := u.changeSettings()
+
+	if len(args) < 2 {
+		if !cs.enabled {
+			return cmdReply{"You don't receive notifications of changes in your calendars", ""}, nil
+		}
+
+		lines := []string{"You are notified of changes in your calendars to events in the coming " + formatHorizon(cs.horizon)}
+		linesF := []string{"You are notified of changes in your calendars to events in the coming <b>" + formatHorizon(cs.horizon) + "</b>"}
+
+		u.calendarsMutex.RLock()
+		for _, uc := range u.calendars {
+			if !uc.notifiesChanges() {
+				lines = append(lines, "except for calendar "+uc.Name)
+				linesF = append(linesF, "except for calendar <b>"+html.EscapeString(uc.Name)+"</b>")
+			}
+		}
+		u.calendarsMutex.RUnlock()
+
+		return cmdReply{strings.Join(lines, "\n"), strings.Join(linesF, "<br />")}, nil
+	}
+
+	switch args[1] {
+	case "on":
+		cs.enabled = true
+		return cmdReply{"You will be notified of changes in your calendars", ""}, u.setChangeSettings(cs)
+	case "off":
+		cs.enabled = false
+		return cmdReply{"You will no longer be notified of changes in your calendars", ""}, u.setChangeSettings(cs)
+	case "horizon":
+		if len(args) < 3 {
+			return formatUsage(usageChangesHorizon), nil
+		}
+
+		horizon, err := parseHorizon(args[2])
+		if err != nil {
+			return cmdReply{"Invalid horizon specified, use something like 48h or 3d", ""}, nil
+		}
+
+		cs.horizon = horizon
+		return cmdReply{
+			"You will be notified of changes to events in the coming " + formatHorizon(horizon),
+			"You will be notified of changes to events in the coming <b>" + formatHorizon(horizon) + "</b>"}, u.setChangeSettings(cs)
+	}
+
+	if len(args) < 3 || (args[2] != "on" && args[2] != "off") {
+		return formatUsage(usageChangesCalendar), nil
+	}
+
+	name := args[1]
+	uc := u.calendar(name)
+	if uc == nil {
+		return cmdReply{
+			"There is no calendar named " + name,
+			"There is no calendar named <b>" + name + "</b>"}, nil
+	}
+
+	notify := args[2] == "on"
+	err := uc.setNotifyChanges(u.persist, notify)
+	if err != nil {
+		return cmdReply{}, err
+	}
+
+	if notify {
+		return cmdReply{
+			"You will be notified of changes in calendar " + name,
+			"You will be notified of changes in calendar <b>" + name + "</b>"}, nil
+	}
+	return cmdReply{
+		"You will no longer be notified of changes in calendar " + name,
+		"You will no longer be notified of changes in calendar <b>" + name + "</b>"}, nil
+}
+
+// joinReplies combines the replies to a command into a single message.
+func joinReplies(replies []cmdReply) cmdReply {
+	if len(replies) == 1 {
+		return replies[0]
+	}
+
+	msgs := []string{}
+	msgsF := []string{}
+	for _, reply := range replies {
+		msgF := reply.msgF
+		if msgF == "" {
+			msgF = strings.ReplaceAll(html.EscapeString(reply.msg), "\n", "<br />\n")
+		}
+
+		msgs = append(msgs, reply.msg)
+		msgsF = append(msgsF, msgF)
+	}
+
+	return cmdReply{strings.Join(msgs, "\n\n"), strings.Join(msgsF, "<br />\n<br />\n")}
 }
 
 type helpSection struct {
@@ -364,11 +1067,13 @@ var helpCal = helpSection{
 		{"cal", "List your calendars", ""},
 		usageCalAdd,
 		usageCalRemove,
+		usageCalRoom,
 	},
 }
 var helpView = helpSection{
 	"Viewing events in your calendars",
 	[]helpCommand{
+		{"today", "View your schedule for today", ""},
 		{"week", "View your schedule for this week", ""},
 		{"week {number}", "View your schedule for the specified week", ""},
 		{"week {year} {number}", "View your schedule for the specified week", ""},
@@ -377,11 +1082,51 @@ var helpView = helpSection{
 	},
 }
 
+var helpReminders = helpSection{
+	"Reminders",
+	[]helpCommand{
+		{"reminders", "View your reminder settings", ""},
+		usageUpcomingReminders,
+		usageSnooze,
+		usageRemindersRepeat,
+		usageRemindersEnd,
+		{"reminders end off", "Stop reminders before the end of events", ""},
+		usageRemindersAllDay,
+		{"reminders allday reset", "Be reminded of all-day events like of other events", ""},
+		{"reminders template", "View the templates reminders are formatted with", ""},
+		usageRemindersTemplate,
+		usageRemindersTemplateHTML,
+		{"reminders template reset", "Use the default reminder templates", ""},
+		usageRemindersEnded,
+		usageQuiet,
+		{"quiet {batch|drop}", "Whether reminders during quiet hours or a pause are sent afterwards in one message, or dropped", ""},
+		{"quiet off", "Disable your quiet hours", ""},
+		usagePause,
+		{"resume", "Resume reminders after a pause", ""},
+		{"changes {on|off}", "Whether to be notified when events in your calendars are added, moved or cancelled", ""},
+		usageChangesHorizon,
+		usageChangesCalendar,
+	},
+}
+
+var helpSettings = helpSection{
+	"Settings",
+	[]helpCommand{
+		usageTimezone,
+		usageDigest,
+		{"digest off", "Stop receiving the daily digest", ""},
+		usageWeekly,
+		{"weekly {preview|review} off", "Stop receiving the weekly preview or review", ""},
+		{"rooms", "List the rooms in which you talk to the bot", ""},
+		usageUseRoom,
+	},
+}
+
 func formatAllHelp() cmdReply {
 	lines := []string{"Use these commands to interact with the bot", ""}
 	linesF := []string{"<b>Use these commands to interact with the bot</b>", ""}
 
-	for i, s := range []helpSection{helpCal, helpView} {
+	for i, s := range []helpSection{helpCal, helpView, helpReminders, helpSettings} {
 		if i > 0 {
 			lines = append(lines, "")
 			linesF = append(linesF, "")
@@ -418,6 +1163,12 @@ var usageCalAdd = helpCommand{
 	"cal add personal caldav https://mysite.nl/calendar/3owevfu1d0rb3psw",
 }
 
+var usageCalRoom = helpCommand{
+	"cal room {name} [{room ID}|here|reset]",
+	"Send reminders and changes of the calendar to another room, which both you and the bot have joined",
+	"cal room team !abcdefghijklmnop:example.org",
+}
+
 var usageCalRemove = helpCommand{
 	"cal remove {name}",
 	"Remove the specified calendar from the bot",
@@ -429,7 +1180,91 @@ func formatUsage(usage helpCommand) cmdReply {
 	msgF := fmt.Sprintf("<b>Usage</b>: %s<br />\n%s", usage.cmd, usage.info)
 	if usage.example != "" {
 		msg += "\n\nExample: " + usage.example
-		msgF += "<br />\n<br />\n<b>Example</b>: " + usage.example
+		msgF += "<br />\n<br />\n<b>Example</b>: " + html.EscapeString(usage.example)
 	}
 	return cmdReply{msg, msgF}
 }
+
+var usageTimezone = helpCommand{
+	"timezone {name}",
+	"Set your timezone, used for viewing your schedule and sending messages",
+	"timezone Europe/Amsterdam",
+}
+
+var usageDigest = helpCommand{
+	"digest daily {time} [skipempty]",
+	"Receive your agenda for the day every day at the specified time, optionally not on days without events",
+	"digest daily 07:30",
+}
+
+var usageWeekly = helpCommand{
+	"weekly {preview|review} [{day} {time}]",
+	"Receive next week's agenda (by default on sunday 19:00), or a review of this week with time spent in meetings (by default on friday 17:00)",
+	"weekly preview sunday 20:00",
+}
+
+var usageRemindersRepeat = helpCommand{
+	"reminders repeat {on|off}",
+	"Whether to be reminded again at the start of an event when you didn't acknowledge the earlier reminder",
+	"reminders repeat off",
+}
+
+var usageQuiet = helpCommand{
+	"quiet {from} {until}",
+	"Don't receive reminders between the specified times each day",
+	"quiet 22:00 07:00",
+}
+
+var usagePause = helpCommand{
+	"pause until {date}",
+	"Don't receive any reminders until the specified date, for example during a vacation",
+	"pause until 2020-12-31",
+}
+
+var usageChangesHorizon = helpCommand{
+	"changes horizon {duration}",
+	"Only be notified of changes to events starting within the specified time",
+	"changes horizon 3d",
+}
+
+var usageChangesCalendar = helpCommand{
+	"changes {calendar} {on|off}",
+	"Whether to be notified of changes in the specified calendar",
+	"changes work off",
+}
+
+var usageRemindersEnd = helpCommand{
+	"reminders end {minutes}",
+	"Be reminded the specified amount of minutes before events end",
+	"reminders end 10",
+}
+
+var usageRemindersAllDay = helpCommand{
+	"reminders allday {time} [daybefore]",
+	"Announce all-day events at the specified time, on the day itself or the day before, instead of at midnight",
+	"reminders allday 08:00",
+}
+
+var usageRemindersTemplate = helpCommand{
+	"reminders template {template}",
+	"Format reminders with the template, which can use {{.Title}}, {{.When}}, {{.Time}}, {{.Location}}, {{.Description}}, {{.Calendar}} and {{.Link}}, the link to join the meeting",
+	`reminders template {{.Title}} at {{.Time}} in {{.Location}}`,
+}
+
+var usageRemindersTemplateHTML = helpCommand{
+	"reminders template html {template}",
+	"Format reminders in HTML with the template",
+	`reminders template html <b>{{.Title}}</b> {{.When}} {{if .Link}}<a href="{{.Link}}">Join</a>{{end}}`,
+}
+
+var usageRemindersEnded = helpCommand{
+	"reminders ended {keep|edit|redact}",
+	"Keep reminder messages after their events ended, change them to say the event ended, or remove them",
+	"reminders ended redact",
+}
+
+var usageUpcomingReminders = helpCommand{
+	"upcoming reminders",
+	"View the reminders which are scheduled to be sent",
+	"",
+}
@@ -48,8 +48,56 @@ func TestTimeStartOfYearPlusWeeks(t *testing.T) {
 	}
 }
 
+func TestTimeStartOfWeek(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Amsterdam")
+	if err != nil {
+		t.Error(err)
+	}
+
+	var tests = []struct {
+		base   time.Time
+		expect time.Time
+	}{
+		{
+			time.Date(2020, 11, 9, 10, 0, 0, 0, loc),
+			time.Date(2020, 11, 9, 0, 0, 0, 0, loc),
+		},
+		{
+			time.Date(2020, 11, 12, 10, 0, 0, 0, loc),
+			time.Date(2020, 11, 9, 0, 0, 0, 0, loc),
+		},
+		{
+			time.Date(2020, 11, 15, 19, 0, 0, 0, loc),
+			time.Date(2020, 11, 9, 0, 0, 0, 0, loc),
+		},
+		{
+			time.Date(2021, 1, 1, 10, 0, 0, 0, loc),
+			time.Date(2020, 12, 28, 0, 0, 0, 0, loc),
+		},
+	}
+
+	for _, test := range tests {
+		assertTimeEquals(t, test.expect, timeStartOfWeek(test.base, loc))
+	}
+}
+
 func assertTimeEquals(t *testing.T, expect, got time.Time) {
 	if expect != got {
 		t.Error("Expected:", expect, " got:", got)
 	}
 }
+
+func TestJoinReplies(t *testing.T) {
+	reply := joinReplies([]cmdReply{{"Set", "<b>Set</b>"}})
+	assertEqual(t, reply, cmdReply{"Set", "<b>Set</b>"}, "single reply is kept")
+
+	reply = joinReplies([]cmdReply{
+		{"Unknown command", ""},
+		{"Help\n* week", "<b>Help</b><br />\n* week"},
+	})
+	assertEqual(t, reply.msg, "Unknown command\n\nHelp\n* week", "plain replies are joined")
+	assertEqual(t, reply.msgF, "Unknown command<br />\n<br />\n<b>Help</b><br />\n* week", "formatted replies are joined")
+
+	reply = joinReplies([]cmdReply{{"a < b", ""}, {"c", ""}})
+	assertEqual(t, reply.msgF, "a &lt; b<br />\n<br />\nc", "plain replies are escaped")
+}
@@ -10,12 +10,79 @@ import (
 type config struct {
 	MatrixBot configMatrixBot `json:"matrix_bot"`
 	SQLiteURI string          `json:"sqlite_uri"`
+
+	// RetentionDays is how many days the data of users is kept after they left
+	// the room of the bot, 0 deletes it right away.
+	RetentionDays int `json:"retention_days"`
 }
 
 type configMatrixBot struct {
 	Homeserver string `json:"homeserver"`
 	AccountID  string `json:"account_id"`
 	Token      string `json:"token"`
+
+	// Password or LoginToken are used to log in when no token is configured.
+	// The access token and device of the login are stored in the database and
+	// reused after restarts. With a password, the bot logs in again when its
+	// token expires.
+	Password   string `json:"password"`
+	LoginToken string `json:"login_token"`
+
+	// MissedCommandsMaxAge is the age in minutes up to which messages sent
+	// while the bot was offline are still handled.
+	MissedCommandsMaxAge int `json:"missed_commands_max_age"`
+
+	// Encryption enables end-to-end encryption, which requires the ID of the
+	// device the token belongs to, unless the bot logs in itself. The pickle
+	// key encrypts the stored keys.
+	Encryption bool   `json:"encryption"`
+	DeviceID   string `json:"device_id"`
+	PickleKey  string `json:"pickle_key"`
+
+	// GroupRooms allows the bot to join rooms other than direct chats.
+	GroupRooms bool `json:"group_rooms"`
+
+	// CommandPrefixes start commands outside of direct chats, like "!cal week".
+	// Mentioning the bot works too.
+	CommandPrefixes []string `json:"command_prefixes"`
+
+	// AdminRoom is the room in which the Admins can run admin commands, like
+	// "stats" and "broadcast {message}".
+	AdminRoom string   `json:"admin_room"`
+	Admins    []string `json:"admins"`
+
+	// Appservice runs the bot as an application service, which the homeserver
+	// pushes events to, instead of syncing.
+	Appservice configAppservice `json:"appservice"`
+}
+
+type configAppservice struct {
+	Enabled bool   `json:"enabled"`
+	ID      string `json:"id"`
+
+	// ListenAddress is where the bot listens for transactions, like ":8009".
+	// URL is where the homeserver reaches that, like "http://localhost:8009".
+	ListenAddress string `json:"listen_address"`
+	URL           string `json:"url"`
+
+	// ASToken and HSToken are generated with the registration file when empty.
+	ASToken string `json:"as_token"`
+	HSToken string `json:"hs_token"`
+
+	// Namespaces are the users, room aliases and rooms the appservice is
+	// interested in. By default, it's only the account of the bot.
+	Namespaces configNamespaces `json:"namespaces"`
+}
+
+type configNamespaces struct {
+	Users   []configNamespace `json:"users"`
+	Aliases []configNamespace `json:"aliases"`
+	Rooms   []configNamespace `json:"rooms"`
+}
+
+type configNamespace struct {
+	Regex     string `json:"regex"`
+	Exclusive bool   `json:"exclusive"`
 }
 
 type loadConfigError struct {
@@ -32,8 +99,20 @@ var defaultConfig = config{
 		Homeserver: "https://example.org",
 		AccountID:  "@calendarbot:remi.im",
 		Token:      "",
+
+		MissedCommandsMaxAge: 15,
+
+		CommandPrefixes: defaultCommandPrefixes,
+
+		Appservice: configAppservice{
+			ID:            "calendarbot",
+			ListenAddress: ":8009",
+			URL:           "http://localhost:8009",
+		},
 	},
 	SQLiteURI: "matrix-caldav-bot.db",
+
+	RetentionDays: 30,
 }
 
 // loadConfig unmarhsals the contents of the file with given filename as JSON, which
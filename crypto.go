@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// initCrypto sets up end-to-end encryption for the bot, storing its keys in
+// the database.
+func (m *matrixBot) initCrypto(cfg configMatrixBot, data *store) error {
+	if m.cli.DeviceID == "" {
+		return errors.New("a device_id is required for encryption")
+	}
+
+	m.cryptoStore = crypto.NewSQLCryptoStore(data.persist.db, "sqlite3", cfg.AccountID, m.cli.DeviceID, []byte(cfg.PickleKey), cryptoLogger{})
+	err := m.cryptoStore.CreateTables()
+	if err != nil {
+		return err
+	}
+
+	m.stateStore = newCryptoStateStore(m.cli, data)
+
+	m.mach = crypto.NewOlmMachine(m.cli, cryptoLogger{}, m.cryptoStore, m.stateStore)
+	err = m.mach.Load()
+	if err != nil {
+		return err
+	}
+
+	own := m.mach.OwnIdentity()
+	fmt.Printf("End-to-end encryption enabled, device ID: %s, fingerprint: %s\n", own.DeviceID, own.Fingerprint())
+
+	return nil
+}
+
+// decrypt decrypts the encrypted event, logging failures and events sent by
+// devices which aren't verified.
+func (m matrixBot) decrypt(ev *event.Event) (*event.Event, bool) {
+	decrypted, err := m.mach.DecryptMegolmEvent(ev)
+	if err != nil {
+		fmt.Println("decrypt:", ev.ID, ev.Sender, err)
+		return nil, false
+	}
+
+	devices, err := m.cryptoStore.GetDevices(ev.Sender)
+	if err != nil {
+		fmt.Println("devices:", ev.Sender, err)
+		return decrypted, true
+	}
+
+	verified := false
+	for _, device := range devices {
+		if device.Trust == crypto.TrustStateVerified {
+			verified = true
+		}
+	}
+	if !verified {
+		fmt.Println("Message from user without verified devices:", ev.Sender, ev.ID)
+	}
+
+	return decrypted, true
+}
+
+// encrypt encrypts the content for the room, sharing a group session with the
+// members of the room first if needed.
+func (m matrixBot) encrypt(roomID id.RoomID, content interface{}) (*event.EncryptedEventContent, error) {
+	encrypted, err := m.mach.EncryptMegolmEvent(roomID, event.EventMessage, content)
+	if err != crypto.SessionExpired && err != crypto.SessionNotShared && err != crypto.NoGroupSession {
+		return encrypted, err
+	}
+
+	members, err := m.cli.JoinedMembers(roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	userIDs := make([]id.UserID, 0, len(members.Joined))
+	for userID := range members.Joined {
+		userIDs = append(userIDs, userID)
+	}
+
+	err = m.mach.ShareGroupSession(roomID, userIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.mach.EncryptMegolmEvent(roomID, event.EventMessage, content)
+}
+
+// cryptoStateStore implements crypto.StateStore. The encryption settings of
+// rooms are fetched from the homeserver when first needed.
+type cryptoStateStore struct {
+	cli  *mautrix.Client
+	data *store
+
+	mutex sync.RWMutex
+	// encryption contains the encryption settings of rooms, which are nil for
+	// rooms without encryption.
+	encryption map[id.RoomID]*event.EncryptionEventContent
+}
+
+func newCryptoStateStore(cli *mautrix.Client, data *store) *cryptoStateStore {
+	return &cryptoStateStore{
+		cli:        cli,
+		data:       data,
+		encryption: make(map[id.RoomID]*event.EncryptionEventContent),
+	}
+}
+
+// IsEncrypted reports whether the room uses encryption. Rooms whose settings
+// can't be fetched are assumed to use it.
+func (s *cryptoStateStore) IsEncrypted(roomID id.RoomID) bool {
+	content, err := s.encryptionEvent(roomID)
+	if err != nil {
+		fmt.Println("encryption settings:", roomID, err)
+		return true
+	}
+	return content != nil
+}
+
+func (s *cryptoStateStore) GetEncryptionEvent(roomID id.RoomID) *event.EncryptionEventContent {
+	content, err := s.encryptionEvent(roomID)
+	if err != nil {
+		fmt.Println("encryption settings:", roomID, err)
+	}
+	return content
+}
+
+// encryptionEvent gives the encryption settings of the room, nil when the
+// room doesn't use encryption. Only rooms without the state event are
+// remembered as unencrypted; after other errors the settings are fetched
+// again next time.
+func (s *cryptoStateStore) encryptionEvent(roomID id.RoomID) (*event.EncryptionEventContent, error) {
+	s.mutex.RLock()
+	content, ok := s.encryption[roomID]
+	s.mutex.RUnlock()
+
+	if ok {
+		return content, nil
+	}
+
+	content = &event.EncryptionEventContent{}
+	err := s.cli.StateEvent(roomID, event.StateEncryption, "", content)
+	if isNotFound(err) {
+		// Rooms without encryption don't have the state event.
+		content = nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	s.setEncryption(roomID, content)
+	return content, nil
+}
+
+// isNotFound reports whether the request failed because the homeserver
+// doesn't have what was requested.
+func isNotFound(err error) bool {
+	var httpErr mautrix.HTTPError
+	if !errors.As(err, &httpErr) || httpErr.RespError == nil {
+		return false
+	}
+	return httpErr.RespError.ErrCode == "M_NOT_FOUND"
+}
+
+func (s *cryptoStateStore) setEncryption(roomID id.RoomID, content *event.EncryptionEventContent) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.encryption[roomID] = content
+}
+
+// FindSharedRooms gives the rooms the bot uses for the user.
+func (s *cryptoStateStore) FindSharedRooms(userID id.UserID) []id.RoomID {
+	s.data.usersMutex.RLock()
+	u := s.data.users[userID]
+	s.data.usersMutex.RUnlock()
+
+	if u == nil {
+		return nil
+	}
+
+	return u.rooms()
+}
+
+// cryptoLogger implements crypto.Logger, logging only errors and warnings.
+type cryptoLogger struct{}
+
+func (cryptoLogger) Error(message string, args ...interface{}) {
+	fmt.Printf("crypto error: "+message+"\n", args...)
+}
+
+func (cryptoLogger) Warn(message string, args ...interface{}) {
+	fmt.Printf("crypto warning: "+message+"\n", args...)
+}
+
+func (cryptoLogger) Debug(message string, args ...interface{}) {}
+
+func (cryptoLogger) Trace(message string, args ...interface{}) {}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestCryptoStateStoreEncryptionEvent(t *testing.T) {
+	failing := true
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.Contains(r.URL.Path, "!plain:example.org"):
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errcode": "M_NOT_FOUND", "error": "Event not found."}`)
+		case failing:
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			fmt.Fprint(w, `{"algorithm": "m.megolm.v1.aes-sha2"}`)
+		}
+	}))
+	defer server.Close()
+
+	cli, err := mautrix.NewClient(server.URL, "@calendarbot:example.org", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newCryptoStateStore(cli, nil)
+
+	content, err := s.encryptionEvent(id.RoomID("!plain:example.org"))
+	assertEqual(t, err == nil && content == nil, true, "room without the state event is unencrypted")
+	_, _ = s.encryptionEvent(id.RoomID("!plain:example.org"))
+	assertEqual(t, requests, 1, "unencrypted room is remembered")
+
+	_, err = s.encryptionEvent(id.RoomID("!encrypted:example.org"))
+	assertEqual(t, err != nil, true, "failed request is an error")
+	assertEqual(t, s.IsEncrypted(id.RoomID("!encrypted:example.org")), true, "room is assumed encrypted after an error")
+
+	failing = false
+	content, err = s.encryptionEvent(id.RoomID("!encrypted:example.org"))
+	assertEqual(t, err == nil && content != nil, true, "settings are fetched again after an error")
+}
@@ -14,6 +14,10 @@ type store struct {
 	users      map[id.UserID]*user
 
 	persist *sqlDB
+	sender  messageSender
+
+	// retention is how long the data of users is kept after they left.
+	retention time.Duration
 }
 
 func newDataStore(db *sqlDB) *store {
@@ -31,6 +35,7 @@ func (s *store) populateFromDB() error {
 
 	for _, user := range users {
 		user.persist = s.persist
+		user.sender = s.sender
 		user.existsInDB = true
 
 		s.usersMutex.Lock()
@@ -38,6 +43,19 @@ func (s *store) populateFromDB() error {
 		s.usersMutex.Unlock()
 	}
 
+	rooms, err := s.persist.fetchAllUserRooms()
+	if err != nil {
+		return err
+	}
+
+	for userID, roomIDs := range rooms {
+		u, err := s.user(userID)
+		if err != nil {
+			return err
+		}
+		u.otherRooms = roomIDs
+	}
+
 	cals, err := s.persist.fetchAllCalendars()
 	if err != nil {
 		return err
@@ -48,6 +66,7 @@ func (s *store) populateFromDB() error {
 		if err != nil {
 			return err
 		}
+		u.watchCalendar(uc)
 		u.calendars = append(u.calendars, uc)
 	}
 
@@ -63,41 +82,103 @@ func (s *store) user(id id.UserID) (*user, error) {
 		return d, nil
 	}
 
-	u := user{userID: id, persist: s.persist}
-
 	s.usersMutex.Lock()
+	u := user{userID: id, persist: s.persist, sender: s.sender, reminderRepeat: true,
+		changes: changeSettings{enabled: true, horizon: defaultChangesHorizon}}
 	s.users[id] = &u
 	s.usersMutex.Unlock()
 
 	return &u, nil
 }
 
+// setSender sets the messageSender used by users to send messages to their room.
+func (s *store) setSender(sender messageSender) {
+	s.usersMutex.Lock()
+	defer s.usersMutex.Unlock()
+
+	s.sender = sender
+	for _, u := range s.users {
+		u.mutex.Lock()
+		u.sender = sender
+		u.mutex.Unlock()
+	}
+}
+
+// userKind tells whether a user is a person or a group room.
+type userKind string
+
+const (
+	userKindPerson userKind = "user"
+	userKindGroup  userKind = "group"
+)
+
 type user struct {
-	userID     id.UserID
-	roomID     id.RoomID
+	userID id.UserID
+	kind   userKind
+	// roomID is the room reminders and other messages are sent to.
+	roomID id.RoomID
+	// otherRooms are the other direct chats of the user with the bot.
+	otherRooms []id.RoomID
 	existsInDB bool
 	mutex      sync.RWMutex
 
 	calendarsMutex sync.RWMutex
 	calendars      []*userCalendar
 
+	timezone string
+	loc      *time.Location
+
+	digest      digestSettings
+	digestTimer *recurringTimer
+
+	weeklyPreview weeklyTime
+	weeklyReview  weeklyTime
+	previewTimer  *recurringTimer
+	reviewTimer   *recurringTimer
+
 	persist *sqlDB
+	sender  messageSender
+
+	reminderTimer  *reminderTimer
+	reminders      reminderTracker
+	reminderRepeat bool
+	endReminders   []time.Duration
+	allDayReminder allDayReminder
+	reminderFormat reminderTemplate
+	endedAction    reminderEndedAction
+
+	quiet      quietSettings
+	quietBatch reminderBatch
 
-	reminderTimer reminderTimer
+	changes changeSettings
+
+	// leftAt is when the user left the room, zero if the user didn't.
+	leftAt     time.Time
+	purgeTimer *time.Timer
+
+	// disabled is set by admins to ignore the user and stop their reminders.
+	disabled bool
 }
 
 func (u *user) store(roomID id.RoomID) error {
+	return u.storeAs(roomID, userKindPerson)
+}
+
+// storeAs stores the user as the given kind, with roomID as the room messages
+// are sent to.
+func (u *user) storeAs(roomID id.RoomID, kind userKind) error {
 	u.mutex.RLock()
 	userID := u.userID
 	u.mutex.RUnlock()
 
-	err := u.persist.addUser(userID, roomID)
+	err := u.persist.addUser(userID, roomID, kind)
 	if err != nil {
 		return err
 	}
 
 	u.mutex.Lock()
 	u.roomID = roomID
+	u.kind = kind
 	u.existsInDB = true
 	u.mutex.Unlock()
 
@@ -121,6 +202,29 @@ func (u *user) storeRoomID(roomID id.RoomID) error {
 	return nil
 }
 
+func (u *user) setTimezone(timezone string) error {
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return err
+	}
+
+	u.mutex.RLock()
+	userID := u.userID
+	u.mutex.RUnlock()
+
+	err = u.persist.updateUserTimezone(userID, timezone)
+	if err != nil {
+		return err
+	}
+
+	u.mutex.Lock()
+	u.timezone = timezone
+	u.loc = loc
+	u.mutex.Unlock()
+
+	return nil
+}
+
 func (u *user) addCalendar(name string, calType calendarType, uri string) error {
 	u.mutex.RLock()
 	userID := u.userID
@@ -131,7 +235,8 @@ func (u *user) addCalendar(name string, calType calendarType, uri string) error
 		return err
 	}
 
-	uc := userCalendar{DBID: dbid, Name: name, CalType: calType, URI: uri}
+	uc := userCalendar{DBID: dbid, UserID: userID, Name: name, CalType: calType, URI: uri, NotifyChanges: true}
+	u.watchCalendar(&uc)
 
 	u.mutex.Lock()
 	u.calendars = append(u.calendars, &uc)
@@ -186,6 +291,26 @@ func (u *user) combinedCalendar() (combinedCalendar, error) {
 	return combinedCalendar(cals), nil
 }
 
+// calendar gives the calendar of the user with the given name, or nil.
+func (u *user) calendar(name string) *userCalendar {
+	u.calendarsMutex.RLock()
+	defer u.calendarsMutex.RUnlock()
+	for _, cal := range u.calendars {
+		if cal.Name == name {
+			return cal
+		}
+	}
+
+	return nil
+}
+
+// hasCalendars reports whether the user added any calendars.
+func (u *user) hasCalendars() bool {
+	u.calendarsMutex.RLock()
+	defer u.calendarsMutex.RUnlock()
+	return len(u.calendars) > 0
+}
+
 func (u *user) hasCalendar(name string) bool {
 	u.calendarsMutex.RLock()
 	defer u.calendarsMutex.RUnlock()
@@ -200,18 +325,167 @@ func (u *user) hasCalendar(name string) bool {
 	return false
 }
 
-func (u *user) initialiseReminderTimer(send func(*calendarEvent), forDuration time.Duration) error {
+func (u *user) initialiseReminderTimer(send func([]reminder), forDuration time.Duration) error {
 	cal, err := u.combinedCalendar()
 	if err != nil {
 		return err
 	}
 
-	u.reminderTimer = newReminderTimer(send, forDuration, cal, []time.Duration{0 * time.Second, 30 * time.Minute})
-	return u.reminderTimer.set()
+	timer := newReminderTimer(send, forDuration, cal, []time.Duration{0 * time.Second, 30 * time.Minute})
+	u.mutex.Lock()
+	previous := u.reminderTimer
+	u.reminderTimer = timer
+	u.mutex.Unlock()
+
+	if previous != nil {
+		previous.stop()
+	}
+
+	u.configureReminderTimer()
+	if u.hasLeft() || u.isDisabled() {
+		return nil
+	}
+	return timer.set()
+}
+
+// activeReminderTimer gives the reminder timer of the user, nil when it
+// hasn't been initialised yet.
+func (u *user) activeReminderTimer() *reminderTimer {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	return u.reminderTimer
 }
 
 func (u *user) restartReminderTimer() error {
-	return u.reminderTimer.set()
+	timer := u.activeReminderTimer()
+	if timer == nil || u.hasLeft() || u.isDisabled() {
+		// The reminder timer hasn't been initialised yet, or the user left or
+		// is disabled.
+		return nil
+	}
+
+	// Calendars could have been added or removed.
+	cal, err := u.combinedCalendar()
+	if err != nil {
+		return err
+	}
+	timer.setCalendar(cal)
+
+	u.configureReminderTimer()
+	return timer.set()
+}
+
+// configureReminderTimer applies the reminder settings of the user to its reminder timer.
+func (u *user) configureReminderTimer() {
+	u.mutex.RLock()
+	endReminders := u.endReminders
+	allDay := u.allDayReminder
+	timer := u.reminderTimer
+	u.mutex.RUnlock()
+
+	if timer == nil {
+		return
+	}
+	timer.configure(endReminders, allDay, u.location())
+}
+
+// setReminderTimes stores when the user is reminded of the end of events and
+// of all-day events, and reschedules the reminders.
+func (u *user) setReminderTimes(endReminders []time.Duration, allDay allDayReminder) error {
+	u.mutex.RLock()
+	userID := u.userID
+	u.mutex.RUnlock()
+
+	err := u.persist.updateUserReminderTimes(userID, endReminders, allDay)
+	if err != nil {
+		return err
+	}
+
+	u.mutex.Lock()
+	u.endReminders = endReminders
+	u.allDayReminder = allDay
+	u.mutex.Unlock()
+
+	return u.restartReminderTimer()
+}
+
+// setReminderTemplate stores the templates reminders are formatted with.
+func (u *user) setReminderTemplate(tmpl reminderTemplate) error {
+	u.mutex.RLock()
+	userID := u.userID
+	u.mutex.RUnlock()
+
+	err := u.persist.updateUserReminderTemplate(userID, tmpl)
+	if err != nil {
+		return err
+	}
+
+	u.mutex.Lock()
+	u.reminderFormat = tmpl
+	u.mutex.Unlock()
+
+	return nil
+}
+
+func (u *user) reminderTemplate() reminderTemplate {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	return u.reminderFormat
+}
+
+// setReminderEndedAction stores what happens to reminder messages after their events ended.
+func (u *user) setReminderEndedAction(action reminderEndedAction) error {
+	u.mutex.RLock()
+	userID := u.userID
+	u.mutex.RUnlock()
+
+	err := u.persist.updateUserReminderEnded(userID, action)
+	if err != nil {
+		return err
+	}
+
+	u.mutex.Lock()
+	u.endedAction = action
+	u.mutex.Unlock()
+
+	return nil
+}
+
+func (u *user) reminderEndedAction() reminderEndedAction {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	return u.endedAction
+}
+
+func (u *user) reminderTimes() ([]time.Duration, allDayReminder) {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	return u.endReminders, u.allDayReminder
+}
+
+func (u *user) setReminderRepeat(repeat bool) error {
+	u.mutex.RLock()
+	userID := u.userID
+	u.mutex.RUnlock()
+
+	err := u.persist.updateUserReminderRepeat(userID, repeat)
+	if err != nil {
+		return err
+	}
+
+	u.mutex.Lock()
+	u.reminderRepeat = repeat
+	u.mutex.Unlock()
+
+	return nil
+}
+
+// repeatsReminders reports whether the user wants to be reminded again at the
+// start of events when earlier reminders weren't acknowledged.
+func (u *user) repeatsReminders() bool {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	return u.reminderRepeat
 }
 
 func (u *user) ExistsInDB() bool {
@@ -226,16 +500,39 @@ func (u *user) RoomID() id.RoomID {
 	return u.roomID
 }
 
+// location gives the time zone of the user, the local time zone of the bot
+// if the user hasn't set any.
+func (u *user) location() *time.Location {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	if u.loc == nil {
+		return time.Local
+	}
+	return u.loc
+}
+
+func (u *user) messageSender() messageSender {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	return u.sender
+}
+
 type userCalendar struct {
 	mutex sync.RWMutex
 
-	DBID    int64
-	UserID  id.UserID
-	Name    string
-	CalType calendarType
-	URI     string
+	DBID          int64
+	UserID        id.UserID
+	Name          string
+	CalType       calendarType
+	URI           string
+	NotifyChanges bool
 
-	cal calendar
+	// RoomID is the room reminders for the calendar are sent to, instead of
+	// the room of the user.
+	RoomID id.RoomID
+
+	cal      calendar
+	onUpdate func(previous, current calendarEvents)
 }
 
 func (uc *userCalendar) calendar() (calendar, error) {
@@ -252,8 +549,95 @@ func (uc *userCalendar) calendar() (calendar, error) {
 		}
 
 		// TODO: Cache time from config.
-		uc.cal = newCachedCalendar(uc.cal, 5*time.Minute)
+		cc := newCachedCalendar(uc.cal, 5*time.Minute)
+		cc.name = uc.Name
+		cc.onUpdate = uc.onUpdate
+		uc.cal = cc
 	}
 
 	return uc.cal, err
 }
+
+// reload makes the calendar fetch its events again when next needed.
+func (uc *userCalendar) reload() {
+	uc.mutex.Lock()
+	defer uc.mutex.Unlock()
+
+	if cc, ok := uc.cal.(*cachedCalendar); ok {
+		cc.clean()
+	}
+}
+
+func (uc *userCalendar) notifiesChanges() bool {
+	uc.mutex.RLock()
+	defer uc.mutex.RUnlock()
+	return uc.NotifyChanges
+}
+
+func (uc *userCalendar) setNotifyChanges(persist *sqlDB, notify bool) error {
+	err := persist.updateCalendarNotifyChanges(uc.DBID, notify)
+	if err != nil {
+		return err
+	}
+
+	uc.mutex.Lock()
+	uc.NotifyChanges = notify
+	uc.mutex.Unlock()
+
+	return nil
+}
+
+func (uc *userCalendar) room() id.RoomID {
+	uc.mutex.RLock()
+	defer uc.mutex.RUnlock()
+	return uc.RoomID
+}
+
+func (uc *userCalendar) setRoom(persist *sqlDB, roomID id.RoomID) error {
+	err := persist.updateCalendarRoomID(uc.DBID, roomID)
+	if err != nil {
+		return err
+	}
+
+	uc.mutex.Lock()
+	uc.RoomID = roomID
+	uc.mutex.Unlock()
+
+	return nil
+}
+
+// rooms gives the rooms used for the user.
+func (u *user) rooms() []id.RoomID {
+	rooms := u.directRooms()
+
+	u.calendarsMutex.RLock()
+	defer u.calendarsMutex.RUnlock()
+
+	for _, uc := range u.calendars {
+		roomID := uc.room()
+		if roomID == "" {
+			continue
+		}
+
+		known := false
+		for _, r := range rooms {
+			known = known || r == roomID
+		}
+		if !known {
+			rooms = append(rooms, roomID)
+		}
+	}
+
+	return rooms
+}
+
+// roomFor gives the room messages about the event are sent to.
+func (u *user) roomFor(ev *calendarEvent) id.RoomID {
+	if uc := u.calendar(ev.calendar); uc != nil {
+		if roomID := uc.room(); roomID != "" {
+			return roomID
+		}
+	}
+
+	return u.RoomID()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// digestSettings configures the daily agenda message of a user.
+type digestSettings struct {
+	enabled   bool
+	at        timeOfDay
+	skipEmpty bool
+}
+
+// setDigest stores the digest settings and reschedules the digest.
+func (u *user) setDigest(ds digestSettings) error {
+	u.mutex.RLock()
+	userID := u.userID
+	u.mutex.RUnlock()
+
+	err := u.persist.updateUserDigest(userID, ds)
+	if err != nil {
+		return err
+	}
+
+	u.mutex.Lock()
+	u.digest = ds
+	u.mutex.Unlock()
+
+	u.restartDigestTimer()
+
+	return nil
+}
+
+func (u *user) digestSettings() digestSettings {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	return u.digest
+}
+
+// restartDigestTimer stops the current digest timer of the user, and starts
+// a new one if the user has the digest enabled.
+func (u *user) restartDigestTimer() {
+	u.mutex.Lock()
+
+	if u.digestTimer != nil {
+		u.digestTimer.stop()
+		u.digestTimer = nil
+	}
+
+	if !u.digest.enabled || u.sender == nil || !u.leftAt.IsZero() || u.disabled {
+		u.mutex.Unlock()
+		return
+	}
+
+	// next runs with the mutex of the timer held, so it mustn't take the
+	// mutex of the user, which is held while stopping the timer.
+	at := u.digest.at
+	loc := u.loc
+	if loc == nil {
+		loc = time.Local
+	}
+	next := func(after time.Time) time.Time {
+		return at.nextDaily(after, loc)
+	}
+
+	timer := newRecurringTimer(next, u.sendDigest)
+	u.digestTimer = timer
+	u.mutex.Unlock()
+
+	timer.start()
+}
+
+// sendDigest sends today's agenda to the room of the user.
+func (u *user) sendDigest() {
+	if !u.hasCalendars() {
+		return
+	}
+
+	reply, err := cmdListEvents(u, "today", 0, 0)
+	if err != nil {
+		fmt.Println("digest:", u.userID, err)
+		return
+	}
+
+	if reply.msg == "" {
+		if u.digestSettings().skipEmpty {
+			return
+		}
+		reply = cmdReply{"Nothing planned for today", ""}
+	}
+
+	_, err = u.messageSender().sendMessage(u.RoomID(), reply.msg, reply.msgF, true).wait()
+	if err != nil {
+		fmt.Println("digest:", u.userID, err)
+	}
+}
+
+func setupDigestTimers(data *store) {
+	data.usersMutex.RLock()
+	defer data.usersMutex.RUnlock()
+
+	for _, u := range data.users {
+		u.restartDigestTimer()
+	}
+}
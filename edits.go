@@ -0,0 +1,123 @@
+package main
+
+import (
+	"sync"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// maxCommandReplies is how many replies to recent commands are remembered.
+const maxCommandReplies = 1000
+
+// commandReplies maps the IDs of commands to the IDs of the messages replying
+// to them, and remembers who sent the commands.
+type commandReplies struct {
+	mutex    sync.Mutex
+	replies  map[id.EventID]commandReply
+	commands []id.EventID
+}
+
+type commandReply struct {
+	sender id.UserID
+	reply  id.EventID
+}
+
+func newCommandReplies() *commandReplies {
+	return &commandReplies{replies: make(map[id.EventID]commandReply)}
+}
+
+func (c *commandReplies) add(command id.EventID, sender id.UserID, reply id.EventID) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, ok := c.replies[command]; !ok {
+		c.commands = append(c.commands, command)
+	}
+	c.replies[command] = commandReply{sender, reply}
+
+	if len(c.commands) > maxCommandReplies {
+		delete(c.replies, c.commands[0])
+		c.commands = c.commands[1:]
+	}
+}
+
+// reply gives the reply to the command, if the command was sent by sender.
+func (c *commandReplies) reply(command id.EventID, sender id.UserID) (id.EventID, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	r, ok := c.replies[command]
+	if !ok || r.sender != sender {
+		return "", false
+	}
+	return r.reply, true
+}
+
+func (c *commandReplies) remove(command id.EventID) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.replies, command)
+	c.commands = withoutEvent(c.commands, command)
+}
+
+func withoutEvent(evIDs []id.EventID, evID id.EventID) []id.EventID {
+	kept := []id.EventID{}
+	for _, e := range evIDs {
+		if e != evID {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// replacedEvent gives the ID of the message the content edits, or "" if it
+// isn't an edit.
+func replacedEvent(content *event.MessageEventContent) id.EventID {
+	if content.RelatesTo == nil {
+		return ""
+	}
+	return content.RelatesTo.GetReplaceID()
+}
+
+// editedCommand gives the command as it reads after the edit ev, or false if
+// the edit has no new content.
+func editedCommand(ev *event.Event, original id.EventID) (*event.Event, bool) {
+	newContent := ev.Content.AsMessage().NewContent
+	if newContent == nil {
+		return nil, false
+	}
+
+	edited := *ev
+	edited.ID = original
+	edited.Content = event.Content{Parsed: newContent}
+	return &edited, true
+}
+
+// handleEditedCommand runs the command again when the user edits it, and
+// edits the reply to it with the new result. Edits of other messages are
+// ignored.
+func (m matrixBot) handleEditedCommand(ev *event.Event, original id.EventID, run func(*event.Event) []cmdReply) {
+	// Only the sender of the command can run it again.
+	replyID, ok := m.replies.reply(original, ev.Sender)
+	if !ok {
+		return
+	}
+
+	edited, ok := editedCommand(ev, original)
+	if !ok {
+		return
+	}
+
+	replies := run(edited)
+	if len(replies) == 0 {
+		// The message isn't a command anymore.
+		m.replies.remove(original)
+		m.redactMessage(ev.RoomID, replyID).logFailure("redact reply " + replyID.String())
+		return
+	}
+
+	reply := joinReplies(replies)
+	m.editMatrixMessage(ev.RoomID, replyID, reply.msg, reply.msgF, event.MsgNotice).logFailure("edit reply " + replyID.String())
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestCommandReplies(t *testing.T) {
+	c := newCommandReplies()
+	c.add("$command", "@user:example.org", "$reply")
+
+	reply, ok := c.reply("$command", "@user:example.org")
+	assertEqual(t, ok, true, "reply is remembered")
+	assertEqual(t, reply, id.EventID("$reply"), "reply ID is remembered")
+
+	_, ok = c.reply("$command", "@other:example.org")
+	assertEqual(t, ok, false, "edits by others than the sender are ignored")
+
+	c.remove("$command")
+	_, ok = c.reply("$command", "@user:example.org")
+	assertEqual(t, ok, false, "removed reply is forgotten")
+
+	for i := 0; i <= maxCommandReplies; i++ {
+		c.add(id.EventID("$command"+strconv.Itoa(i)), "@user:example.org", "$reply")
+	}
+	_, ok = c.reply("$command0", "@user:example.org")
+	assertEqual(t, ok, false, "oldest reply is forgotten")
+	_, ok = c.reply(id.EventID("$command"+strconv.Itoa(maxCommandReplies)), "@user:example.org")
+	assertEqual(t, ok, true, "newest reply is remembered")
+}
+
+func TestEditedCommand(t *testing.T) {
+	ev := &event.Event{
+		ID:     "$edit",
+		RoomID: "!room:example.org",
+		Content: event.Content{Parsed: &event.MessageEventContent{
+			Body:       "* week 13",
+			RelatesTo:  &event.RelatesTo{Type: event.RelReplace, EventID: "$command"},
+			NewContent: &event.MessageEventContent{Body: "week 13"},
+		}},
+	}
+
+	edited, ok := editedCommand(ev, "$command")
+	assertEqual(t, ok, true, "edit has new content")
+	assertEqual(t, edited.Content.AsMessage().Body, "week 13", "new content is used")
+	assertEqual(t, edited.ID, id.EventID("$command"), "edited command has the ID of the original")
+	assertEqual(t, edited.RoomID, ev.RoomID, "edited command is in the same room")
+
+	ev.Content = event.Content{Parsed: &event.MessageEventContent{Body: "* week 13"}}
+	_, ok = editedCommand(ev, "$command")
+	assertEqual(t, ok, false, "edit without new content is ignored")
+}
+
+func TestReplacedEvent(t *testing.T) {
+	edit := &event.MessageEventContent{RelatesTo: &event.RelatesTo{Type: event.RelReplace, EventID: "$command"}}
+	assertEqual(t, replacedEvent(edit), id.EventID("$command"), "edit replaces the command")
+	assertEqual(t, replacedEvent(&event.MessageEventContent{Body: "week"}), id.EventID(""), "message without relation isn't an edit")
+}
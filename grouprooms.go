@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// Group rooms are stored like users of the group kind, identified by their
+// room ID, so their calendars, settings and reminders work like those of
+// users. Reminders of a group room are sent to the room itself.
+
+// formatWelcomeGroup gives the welcome message for group rooms, in which
+// commands start with the prefix.
+func formatWelcomeGroup(prefix string) cmdReply {
+	return cmdReply{
+		"Hi! I show this room's shared calendars and post reminders of their events here.\n\n" +
+			"Start commands with " + prefix + " or mention me, like: " + prefix + " cal add team ical https://example.org/team.ics\n" +
+			"Moderators can add and remove calendars, everyone can view them with " + prefix + " week.",
+		"Hi! I show this room's shared calendars and post reminders of their events here.<br />\n<br />\n" +
+			"Start commands with <code>" + prefix + "</code> or mention me, like: <code>" + prefix + " cal add team ical https://example.org/team.ics</code><br />\n" +
+			"Moderators can add and remove calendars, everyone can view them with <code>" + prefix + " week</code>.",
+	}
+}
+
+// groupRoom gives the group room with the given ID, or nil if it isn't one.
+func (s *store) groupRoom(roomID id.RoomID) *user {
+	s.usersMutex.RLock()
+	defer s.usersMutex.RUnlock()
+
+	r := s.users[id.UserID(roomID)]
+	if r == nil || !r.ExistsInDB() || !r.isGroupRoom() {
+		return nil
+	}
+	return r
+}
+
+// addGroupRoom registers the room as group room.
+func (s *store) addGroupRoom(roomID id.RoomID) (*user, error) {
+	r, err := s.user(id.UserID(roomID))
+	if err != nil {
+		return nil, err
+	}
+
+	if r.ExistsInDB() {
+		if !r.isGroupRoom() {
+			return nil, fmt.Errorf("%s is already stored as a user", roomID)
+		}
+		return r, nil
+	}
+
+	err = r.storeAs(roomID, userKindGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	r.startReminders()
+	return r, nil
+}
+
+// isGroupRoom reports whether the user is a group room.
+func (u *user) isGroupRoom() bool {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	return u.kind == userKindGroup
+}
+
+// groupCommandNeedsPermission reports whether the command changes the
+// calendars or settings of the room, which only moderators can do.
+func groupCommandNeedsPermission(args []string) bool {
+	switch args[0] {
+	case "events", "week", "today", "next", "last", "prev", "previous", "upcoming", "help", "?":
+		return false
+	case "cal", "calendar":
+		return len(args) >= 2 && args[1] != "list"
+	}
+
+	return true
+}
+
+// canManageRoom reports whether the user has the power level to change the
+// state of the room.
+func canManageRoom(cli *mautrix.Client, roomID id.RoomID, userID id.UserID) (bool, error) {
+	pl := event.PowerLevelsEventContent{}
+	err := cli.StateEvent(roomID, event.StatePowerLevels, "", &pl)
+	if err != nil {
+		return false, err
+	}
+
+	return pl.GetUserLevel(userID) >= pl.StateDefault(), nil
+}
+
+// handleGroupCommand handles messages in group rooms, which are commands
+// only when they start with a command prefix or a mention of the bot.
+func handleGroupCommand(cli *mautrix.Client, commands commandMatcher, r *user, ev *event.Event, started func()) []cmdReply {
+	str, ok := commands.match(ev.Content.AsMessage())
+	if !ok || r.isDisabled() {
+		return nil
+	}
+	started()
+
+	args := strings.Split(strings.ToLower(str), " ")
+	if groupCommandNeedsPermission(args) {
+		allowed, err := canManageRoom(cli, ev.RoomID, ev.Sender)
+		if err != nil {
+			fmt.Println(err)
+			return []cmdReply{{"Oops, something went wrong", ""}}
+		}
+		if !allowed {
+			return []cmdReply{{"Only moderators of this room can change its calendars and settings", ""}}
+		}
+	}
+
+	return runCommand(cli, r, ev.RoomID, str)
+}
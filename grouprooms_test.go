@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestGroupCommandNeedsPermission(t *testing.T) {
+	var tests = []struct {
+		args   []string
+		expect bool
+	}{
+		{[]string{"week"}, false},
+		{[]string{"cal"}, false},
+		{[]string{"cal", "list"}, false},
+		{[]string{"cal", "add", "team", "ical", "https://example.org/team.ics"}, true},
+		{[]string{"cal", "remove", "team"}, true},
+		{[]string{"timezone", "Europe/Amsterdam"}, true},
+	}
+
+	for _, test := range tests {
+		assertEqual(t, groupCommandNeedsPermission(test.args), test.expect, "permission is required correctly")
+	}
+}
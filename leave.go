@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// handleLeave handles users leaving their room, and the bot being kicked or
+// banned from the room of a user. The reminders of the user are stopped, and
+// the data of the user is deleted after the retention period.
+func handleLeave(cli *mautrix.Client, us id.UserID, data *store, ev *event.Event) {
+	membership := ev.Content.AsMember().Membership
+	if membership != event.MembershipLeave && membership != event.MembershipBan {
+		return
+	}
+
+	stateKey := id.UserID(ev.GetStateKey())
+
+	u := data.userInRoom(ev.RoomID)
+	if u == nil || u.hasLeft() {
+		return
+	}
+	if stateKey != us && stateKey != u.userID {
+		// Someone else left the room of the user.
+		return
+	}
+
+	fmt.Println("User left:", u.userID, ev.RoomID, membership)
+
+	var err error
+	if len(u.directRooms()) > 1 {
+		// The user still has other rooms, so only this one is forgotten.
+		err = u.leaveRoom(ev.RoomID)
+	} else {
+		err = data.userLeft(u)
+	}
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	if stateKey != us {
+		_, err = cli.LeaveRoom(ev.RoomID)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// userInRoom gives the user using the room as one of their direct chats, or nil.
+func (s *store) userInRoom(roomID id.RoomID) *user {
+	s.usersMutex.RLock()
+	defer s.usersMutex.RUnlock()
+
+	for _, u := range s.users {
+		if u.hasRoom(roomID) {
+			return u
+		}
+	}
+
+	return nil
+}
+
+func (s *store) setRetention(retention time.Duration) {
+	s.usersMutex.Lock()
+	defer s.usersMutex.Unlock()
+	s.retention = retention
+}
+
+// userLeft stops the timers of the user, and deletes the user after the
+// retention period unless the user returns.
+func (s *store) userLeft(u *user) error {
+	leftAt := time.Now()
+
+	err := u.persist.updateUserLeftAt(u.userID, leftAt)
+	if err != nil {
+		return err
+	}
+
+	u.mutex.Lock()
+	u.leftAt = leftAt
+	u.mutex.Unlock()
+
+	u.stopTimers()
+	s.schedulePurge(u)
+
+	return nil
+}
+
+// userReturned undoes userLeft.
+func (s *store) userReturned(u *user) error {
+	err := u.persist.updateUserLeftAt(u.userID, time.Time{})
+	if err != nil {
+		return err
+	}
+
+	u.mutex.Lock()
+	u.leftAt = time.Time{}
+	if u.purgeTimer != nil {
+		u.purgeTimer.Stop()
+		u.purgeTimer = nil
+	}
+	u.mutex.Unlock()
+
+	u.restartDigestTimer()
+	u.restartWeeklyTimers()
+	return u.restartReminderTimer()
+}
+
+// schedulePurge deletes the user once the retention period after leaving
+// passed, which may be right away.
+func (s *store) schedulePurge(u *user) {
+	s.usersMutex.RLock()
+	retention := s.retention
+	s.usersMutex.RUnlock()
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.purgeTimer != nil {
+		u.purgeTimer.Stop()
+	}
+
+	u.purgeTimer = time.AfterFunc(time.Until(u.leftAt.Add(retention)), func() {
+		err := s.purgeUser(u)
+		if err != nil {
+			fmt.Println("purge user:", u.userID, err)
+		}
+	})
+}
+
+// schedulePurges schedules the deletion of the users which left.
+func (s *store) schedulePurges() {
+	s.usersMutex.RLock()
+	users := make([]*user, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, u)
+	}
+	s.usersMutex.RUnlock()
+
+	for _, u := range users {
+		if u.hasLeft() {
+			s.schedulePurge(u)
+		}
+	}
+}
+
+func (s *store) purgeUser(u *user) error {
+	if !u.hasLeft() {
+		return nil
+	}
+
+	fmt.Println("Deleting user:", u.userID)
+
+	err := s.persist.removeUser(u.userID)
+	if err != nil {
+		return err
+	}
+
+	s.usersMutex.Lock()
+	if s.users[u.userID] == u {
+		delete(s.users, u.userID)
+	}
+	s.usersMutex.Unlock()
+
+	return nil
+}
+
+func (u *user) hasLeft() bool {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	return !u.leftAt.IsZero()
+}
+
+// stopTimers stops sending reminders, digests and weekly messages to the user.
+func (u *user) stopTimers() {
+	u.mutex.Lock()
+	for _, timer := range []*recurringTimer{u.digestTimer, u.previewTimer, u.reviewTimer} {
+		if timer != nil {
+			timer.stop()
+		}
+	}
+	u.digestTimer = nil
+	u.previewTimer = nil
+	u.reviewTimer = nil
+	u.mutex.Unlock()
+
+	if timer := u.activeReminderTimer(); timer != nil {
+		timer.stop()
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+const deviceDisplayName = "Calendar bot"
+
+// errReloginImpossible is returned by relogin when no password is configured,
+// so a new session can't be started without the operator.
+var errReloginImpossible = errors.New("the access token is no longer valid and no password is configured to log in again; " +
+	"configure a new token, password or login_token and restart the bot")
+
+// login sets the credentials of the client. A configured token is used as is.
+// Otherwise the session stored in the database is reused, or the bot logs in
+// with its password or login token and stores the new session.
+func (m *matrixBot) login(cfg configMatrixBot, persist *sqlDB) error {
+	us := id.UserID(cfg.AccountID)
+
+	if cfg.Token != "" {
+		m.cli.SetCredentials(us, cfg.Token)
+		m.cli.DeviceID = id.DeviceID(cfg.DeviceID)
+		return nil
+	}
+
+	deviceID, accessToken, err := persist.fetchSession(us)
+	if err != nil {
+		return err
+	}
+	if accessToken != "" {
+		m.cli.SetCredentials(us, accessToken)
+		m.cli.DeviceID = deviceID
+		return nil
+	}
+
+	req := &mautrix.ReqLogin{
+		Identifier:               mautrix.UserIdentifier{Type: mautrix.IdentifierTypeUser, User: cfg.AccountID},
+		DeviceID:                 id.DeviceID(cfg.DeviceID),
+		InitialDeviceDisplayName: deviceDisplayName,
+	}
+	switch {
+	case cfg.Password != "":
+		req.Type = mautrix.AuthTypePassword
+		req.Password = cfg.Password
+	case cfg.LoginToken != "":
+		req.Type = mautrix.AuthTypeToken
+		req.Token = cfg.LoginToken
+	default:
+		return errors.New("a token, password or login_token is required")
+	}
+
+	return m.logInWith(us, req, persist)
+}
+
+// relogin logs in again with the password after the access token expired or
+// was invalidated, keeping the device so its encryption keys stay valid.
+// Without a password the stored session is forgotten, so the next start logs
+// in with the configured credentials, and errReloginImpossible is returned.
+func (m *matrixBot) relogin(cfg configMatrixBot, persist *sqlDB) error {
+	us := id.UserID(cfg.AccountID)
+
+	if cfg.Password == "" {
+		err := persist.updateSession(us, m.cli.DeviceID, "")
+		if err != nil {
+			fmt.Println(err)
+		}
+		return errReloginImpossible
+	}
+	req := &mautrix.ReqLogin{
+		Type:       mautrix.AuthTypePassword,
+		Identifier: mautrix.UserIdentifier{Type: mautrix.IdentifierTypeUser, User: cfg.AccountID},
+		Password:   cfg.Password,
+		DeviceID:   m.cli.DeviceID,
+	}
+
+	return m.logInWith(us, req, persist)
+}
+
+func (m *matrixBot) logInWith(us id.UserID, req *mautrix.ReqLogin, persist *sqlDB) error {
+	resp, err := m.cli.Login(req)
+	if err != nil {
+		return err
+	}
+
+	m.cli.SetCredentials(us, resp.AccessToken)
+	m.cli.DeviceID = resp.DeviceID
+	fmt.Println("Logged in, device ID:", resp.DeviceID)
+
+	return persist.updateSession(us, resp.DeviceID, resp.AccessToken)
+}
+
+// isUnknownToken reports whether the request failed because the access token
+// is no longer valid, like after a soft logout.
+func isUnknownToken(err error) bool {
+	var httpErr mautrix.HTTPError
+	if !errors.As(err, &httpErr) || httpErr.RespError == nil {
+		return false
+	}
+	return httpErr.RespError.ErrCode == "M_UNKNOWN_TOKEN"
+}
+
+// reloginSyncer stops syncing when the access token is no longer valid, so
+// the bot can log in again. Other failed syncs are retried as usual.
+type reloginSyncer struct {
+	*mautrix.DefaultSyncer
+}
+
+func (s reloginSyncer) OnFailedSync(res *mautrix.RespSync, err error) (time.Duration, error) {
+	if isUnknownToken(err) {
+		return 0, err
+	}
+	return s.DefaultSyncer.OnFailedSync(res, err)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix"
+)
+
+func TestIsUnknownToken(t *testing.T) {
+	httpErr := func(status int, errCode string) mautrix.HTTPError {
+		req, _ := http.NewRequest(http.MethodGet, "https://example.org/_matrix/client/r0/sync", nil)
+		res := &http.Response{StatusCode: status, Status: http.StatusText(status)}
+		if errCode == "" {
+			return mautrix.HTTPError{Request: req, Response: res}
+		}
+		return mautrix.HTTPError{Request: req, Response: res, RespError: &mautrix.RespError{ErrCode: errCode}}
+	}
+	unknownToken := httpErr(401, "M_UNKNOWN_TOKEN")
+
+	var tests = []struct {
+		err    error
+		expect bool
+	}{
+		{unknownToken, true},
+		{fmt.Errorf("sync: %w", unknownToken), true},
+		{httpErr(403, "M_FORBIDDEN"), false},
+		{httpErr(502, ""), false},
+		{errors.New("connection refused"), false},
+	}
+
+	for _, test := range tests {
+		assertEqual(t, isUnknownToken(test.err), test.expect, "unknown token is detected in "+test.err.Error())
+	}
+}
+
+func TestReloginSyncerStopsOnUnknownToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasSuffix(r.URL.Path, "/filter") {
+			fmt.Fprint(w, `{"filter_id": "1"}`)
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"errcode": "M_UNKNOWN_TOKEN", "error": "Invalid macaroon passed.", "soft_logout": true}`)
+	}))
+	defer server.Close()
+
+	cli, err := mautrix.NewClient(server.URL, "@calendarbot:example.org", "expired")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.Syncer = reloginSyncer{cli.Syncer.(*mautrix.DefaultSyncer)}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cli.Sync()
+	}()
+
+	select {
+	case err = <-done:
+	case <-time.After(5 * time.Second):
+		cli.StopSync()
+		t.Fatal("sync didn't stop on an unknown token")
+	}
+	assertEqual(t, isUnknownToken(err), true, "sync returns the unknown token error")
+}
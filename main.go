@@ -9,6 +9,7 @@ import (
 
 func main() {
 	cfgFileName := flag.String("config", "config.json", "")
+	registrationFileName := flag.String("generate-registration", "", "write the appservice registration to this file and exit")
 	flag.Parse()
 
 	cfg, isNew, err := loadConfig(*cfgFileName)
@@ -25,6 +26,21 @@ func main() {
 		return
 	}
 
+	if *registrationFileName != "" {
+		err = generateRegistration(&cfg.MatrixBot, *registrationFileName)
+		if err == nil {
+			// The generated tokens are needed to run the appservice.
+			err = createConfig(*cfgFileName, cfg)
+		}
+		if err != nil {
+			fmt.Println("Error generating appservice registration:", err)
+			os.Exit(5)
+		}
+
+		fmt.Printf("Appservice registration saved as %s. Add it to the configuration of your homeserver.\n", *registrationFileName)
+		return
+	}
+
 	db, err := initSQLDB(cfg.SQLiteURI)
 	if err != nil {
 		fmt.Println("Error initialising database:", err)
@@ -32,6 +48,7 @@ func main() {
 	}
 
 	data := newDataStore(db)
+	data.setRetention(time.Duration(cfg.RetentionDays) * 24 * time.Hour)
 
 	fmt.Println("Reading database into memory...")
 
@@ -40,6 +57,8 @@ func main() {
 		fmt.Println(err)
 	}
 
+	data.schedulePurges()
+
 	fmt.Println("Initialising Matrix bot...")
 
 	m, err := initMatrixBot(cfg.MatrixBot, data)
@@ -48,48 +67,30 @@ func main() {
 		os.Exit(3)
 	}
 
+	data.setSender(m)
+
 	fmt.Println("Setting up reminder timers...")
 
 	if true {
-		setupReminderTimers(m, data)
+		setupReminderTimers(data)
 	}
 
+	fmt.Println("Setting up digest timers...")
+
+	setupDigestTimers(data)
+
+	fmt.Println("Setting up weekly timers...")
+
+	setupWeeklyTimers(data)
+
 	fmt.Println("Done")
 
 	<-make(chan struct{})
 }
 
-func setupReminderTimers(m matrixBot, data *store) {
+func setupReminderTimers(data *store) {
 	for _, user := range data.users {
-		send := func(ev *calendarEvent) {
-			msg := ""
-
-			timeUntil := ev.from.Sub(time.Now())
-
-			if timeUntil.Minutes() > 0 {
-				msg = fmt.Sprintf("Reminder: %q starts in %d minutes", ev.text, int(timeUntil.Minutes()))
-			} else {
-				msg = fmt.Sprintf("Reminder: %q starts now", ev.text)
-			}
-			m.sendMessage(user.roomID, msg, "")
-		}
-
-		go func() {
-			err := user.initialiseReminderTimer(send, 65*time.Minute)
-			if err != nil {
-				fmt.Println(err)
-			}
-
-			for {
-				<-time.After(60 * time.Minute)
-				fmt.Println("call setup reminder timers")
-				err = user.restartReminderTimer()
-				if err != nil {
-					fmt.Println(err)
-				}
-				fmt.Println("done call setup reminder timers")
-			}
-		}()
+		user.startReminders()
 		<-time.After(100 * time.Millisecond)
 	}
 }
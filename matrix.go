@@ -1,62 +1,215 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"os"
 	"time"
 
 	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
 
 type matrixBot struct {
-	cli *mautrix.Client
+	cli   *mautrix.Client
+	queue *outboundQueue
+
+	// replies tracks the replies to commands, to edit them when the command
+	// is edited.
+	replies *commandReplies
+
+	// mach is nil when encryption is disabled.
+	mach        *crypto.OlmMachine
+	cryptoStore *crypto.SQLCryptoStore
+	stateStore  *cryptoStateStore
+}
+
+// messageSender sends messages to Matrix rooms.
+type messageSender interface {
+	// sendMessage sends the message; durable messages, like scheduled
+	// reminders, are kept until sent, even across restarts.
+	sendMessage(roomID id.RoomID, msg string, msgF string, durable bool) pendingMessage
+	sendNotice(roomID id.RoomID, msg string, msgF string) pendingMessage
+	editMessage(roomID id.RoomID, original id.EventID, msg string, msgF string) pendingMessage
+	redactMessage(roomID id.RoomID, evID id.EventID) pendingMessage
 }
 
 func initMatrixBot(cfg configMatrixBot, data *store) (matrixBot, error) {
 	us := id.UserID(cfg.AccountID)
-	cli, err := mautrix.NewClient(cfg.Homeserver, us, cfg.Token)
-	m := matrixBot{cli}
+	cli, err := mautrix.NewClient(cfg.Homeserver, us, "")
+	m := matrixBot{cli: cli, queue: newOutboundQueue(data.persist), replies: newCommandReplies()}
 	if err != nil {
 		return m, err
 	}
 
+	if cfg.Appservice.Enabled {
+		if cfg.Encryption {
+			return m, errors.New("encryption is not supported in appservice mode")
+		}
+		cli.SetCredentials(us, cfg.Appservice.ASToken)
+	} else {
+		err = m.login(cfg, data.persist)
+		if err != nil {
+			return m, err
+		}
+
+		cli.Store = syncStore{data.persist}
+	}
+
+	if cfg.Encryption {
+		err = m.initCrypto(cfg, data)
+		if err != nil {
+			return m, err
+		}
+	}
+
+	commands := newCommandMatcher(us, cfg.CommandPrefixes)
+
+	started := time.Now()
+	maxAge := time.Duration(cfg.MissedCommandsMaxAge) * time.Minute
+
+	// send replies to the event, so it's clear which command the reply is for
+	// when several are sent quickly or while the bot was offline.
+	send := func(ev *event.Event, reply cmdReply) {
+		m.sendReply(ev, reply.msg, reply.msgF).logFailure("reply to " + ev.ID.String())
+	}
+
+	handleMessage := func(_ mautrix.EventSource, ev *event.Event) {
+		if ev.Sender == us || isTooOld(ev, started, maxAge) {
+			return
+		}
+
+		if cfg.AdminRoom != "" && ev.RoomID == id.RoomID(cfg.AdminRoom) {
+			replies := handleAdminCommand(data, cfg.Admins, ev, func(reply cmdReply) {
+				send(ev, reply)
+			})
+			if len(replies) > 0 {
+				send(ev, joinReplies(replies))
+			}
+			return
+		}
+
+		if original := replacedEvent(ev.Content.AsMessage()); original != "" {
+			m.handleEditedCommand(ev, original, func(edited *event.Event) []cmdReply {
+				return handleCommand(cli, data, commands, edited, func() {})
+			})
+			return
+		}
+
+		if reply, ok := handleReminderReply(data, ev); ok {
+			send(ev, reply)
+			return
+		}
+
+		progress := m.newCommandProgress(ev)
+		replies := handleCommand(cli, data, commands, ev, progress.start)
+		if sent := progress.finish(replies); sent != nil {
+			go func() {
+				evID, err := sent.wait()
+				if err != nil {
+					fmt.Println("reply:", ev.ID, err)
+					return
+				}
+				m.replies.add(ev.ID, ev.Sender, evID)
+			}()
+		}
+	}
+	handleReaction := func(_ mautrix.EventSource, ev *event.Event) {
+		if ev.Sender == us || isTooOld(ev, started, maxAge) {
+			return
+		}
+
+		if reply, ok := handleReminderReaction(data, ev); ok {
+			send(ev, reply)
+		}
+	}
+
 	syncer := cli.Syncer.(*mautrix.DefaultSyncer)
-	syncer.OnSync(ignoreOldMessagesSyncHandler)
-	syncer.OnEventType(event.EventMessage, func(_ mautrix.EventSource, ev *event.Event) {
-		if ev.Sender == us {
+	// The default syncer retries forever, also when the token is invalid.
+	cli.Syncer = reloginSyncer{syncer}
+	if m.mach != nil {
+		// The crypto machine needs the keys of the first sync too.
+		syncer.OnSync(func(resp *mautrix.RespSync, since string) bool {
+			m.mach.ProcessSyncResponse(resp, since)
+			return true
+		})
+	}
+	syncer.OnSync(ignoreFirstSyncHandler)
+
+	// The handlers are used for events from syncing and from appservice
+	// transactions alike.
+	handlers := eventHandlers{}
+	on := func(evType event.Type, handler mautrix.EventHandler) {
+		syncer.OnEventType(evType, handler)
+		handlers[evType.Type] = handler
+	}
+
+	on(event.EventMessage, handleMessage)
+	on(event.EventReaction, handleReaction)
+	on(event.EventEncrypted, func(source mautrix.EventSource, ev *event.Event) {
+		if m.mach == nil || ev.Sender == us {
 			return
 		}
 
-		reply := handleCommand(cli, data, ev)
-		for _, msg := range reply {
-			m.sendNotice(ev.RoomID, msg.msg, msg.msgF)
+		decrypted, ok := m.decrypt(ev)
+		if !ok {
+			return
+		}
+
+		switch decrypted.Type {
+		case event.EventMessage:
+			handleMessage(source, decrypted)
+		case event.EventReaction:
+			handleReaction(source, decrypted)
+		}
+	})
+	on(event.StateEncryption, func(_ mautrix.EventSource, ev *event.Event) {
+		if m.stateStore != nil {
+			m.stateStore.setEncryption(ev.RoomID, ev.Content.AsEncryption())
 		}
 	})
-	syncer.OnEventType(event.StateMember, func(_ mautrix.EventSource, ev *event.Event) {
+	on(event.StateMember, func(_ mautrix.EventSource, ev *event.Event) {
+		if m.mach != nil {
+			m.mach.HandleMemberEvent(ev)
+		}
+
+		handleLeave(cli, us, data, ev)
+
 		if ev.Sender == us {
 			return
 		}
-		if ev.Content.AsMember().Membership != "invite" {
+		if ev.GetStateKey() != string(us) || ev.Content.AsMember().Membership != "invite" {
 			return
 		}
 
 		fmt.Println("Invite: ", ev)
-		// TODO: Welcome message
-		// TODO: Support only 1-1 rooms
 
-		resp, err := cli.JoinRoom(ev.RoomID.String(), "", nil)
-		fmt.Println("JoinRoom response:", resp)
-		if err != nil {
-			fmt.Println(err)
-		}
+		handleInvite(cli, m, cfg, commands, data, ev)
 	})
 
+	go m.queue.resendPending(m.sendMessageEvent)
+
+	if cfg.Appservice.Enabled {
+		return m, serveAppservice(cfg.Appservice, handlers)
+	}
+
 	go func() {
 		backOff := 0
 		for {
 			if err := cli.Sync(); err != nil {
 				fmt.Println("Sync() returned ", err)
+				if isUnknownToken(err) {
+					err = m.relogin(cfg, data.persist)
+					if errors.Is(err, errReloginImpossible) {
+						fmt.Println(err)
+						os.Exit(6)
+					}
+					if err != nil {
+						fmt.Println("relogin:", err)
+					}
+				}
 				sleep := backOff * 2
 				<-time.After(time.Duration(sleep) * time.Second)
 				backOff++
@@ -69,15 +222,65 @@ func initMatrixBot(cfg configMatrixBot, data *store) (matrixBot, error) {
 	return m, nil
 }
 
-func (m matrixBot) sendNotice(roomID id.RoomID, msg string, msgF string) error {
-	return m.sendMatrixMessage(roomID, msg, msgF, event.MsgNotice)
+func (m matrixBot) sendNotice(roomID id.RoomID, msg string, msgF string) pendingMessage {
+	return m.sendMatrixMessage(roomID, msg, msgF, event.MsgNotice, false)
+}
+
+func (m matrixBot) sendMessage(roomID id.RoomID, msg string, msgF string, durable bool) pendingMessage {
+	return m.sendMatrixMessage(roomID, msg, msgF, event.MsgText, durable)
+}
+
+func (m matrixBot) sendMatrixMessage(roomID id.RoomID, msg string, msgF string, eventType event.MessageType, durable bool) pendingMessage {
+	ev := event.MessageEventContent{
+		MsgType: eventType,
+		Body:    msg,
+	}
+	if msgF != "" {
+		ev.FormattedBody = msgF
+		ev.Format = event.FormatHTML
+	}
+
+	return m.queue.enqueue(roomID, ev, durable, m.sendMessageEvent)
+}
+
+// sendMessageEvent sends the message content to the room right away,
+// encrypted if the room uses encryption. Other messages are sent through
+// the queue.
+func (m matrixBot) sendMessageEvent(roomID id.RoomID, content interface{}) (id.EventID, error) {
+	evType := event.EventMessage
+
+	if m.mach != nil {
+		// Without the settings of the room, the message isn't sent at all
+		// rather than possibly in plaintext to an encrypted room.
+		settings, err := m.stateStore.encryptionEvent(roomID)
+		if err != nil {
+			return "", err
+		}
+
+		if settings != nil {
+			encrypted, err := m.encrypt(roomID, content)
+			if err != nil {
+				return "", err
+			}
+
+			evType = event.EventEncrypted
+			content = encrypted
+		}
+	}
+
+	resp, err := m.cli.SendMessageEvent(roomID, evType, content)
+	if err != nil {
+		return "", err
+	}
+	return resp.EventID, nil
 }
 
-func (m matrixBot) sendMessage(roomID id.RoomID, msg string, msgF string) error {
-	return m.sendMatrixMessage(roomID, msg, msgF, event.MsgText)
+// editMessage replaces the content of the message original.
+func (m matrixBot) editMessage(roomID id.RoomID, original id.EventID, msg string, msgF string) pendingMessage {
+	return m.editMatrixMessage(roomID, original, msg, msgF, event.MsgText)
 }
 
-func (m matrixBot) sendMatrixMessage(roomID id.RoomID, msg string, msgF string, eventType event.MessageType) error {
+func (m matrixBot) editMatrixMessage(roomID id.RoomID, original id.EventID, msg string, msgF string, eventType event.MessageType) pendingMessage {
 	ev := event.MessageEventContent{
 		MsgType: eventType,
 		Body:    msg,
@@ -86,10 +289,185 @@ func (m matrixBot) sendMatrixMessage(roomID id.RoomID, msg string, msgF string,
 		ev.FormattedBody = msgF
 		ev.Format = event.FormatHTML
 	}
-	_, err := m.cli.SendMessageEvent(roomID, event.EventMessage, ev)
-	return err
+	setEdit(&ev, original)
+
+	return m.queue.enqueue(roomID, ev, false, m.sendMessageEvent)
+}
+
+// setEdit makes the content replace the message original. Clients without
+// support for edits show the body, marked with an asterisk as usual.
+func setEdit(content *event.MessageEventContent, original id.EventID) {
+	newContent := *content
+	content.NewContent = &newContent
+	content.RelatesTo = &event.RelatesTo{Type: event.RelReplace, EventID: original}
+
+	content.Body = "* " + content.Body
+	if content.FormattedBody != "" {
+		content.FormattedBody = "* " + content.FormattedBody
+	}
+}
+
+func (m matrixBot) redactMessage(roomID id.RoomID, evID id.EventID) pendingMessage {
+	return m.queue.enqueue(roomID, nil, false, func(roomID id.RoomID, _ interface{}) (id.EventID, error) {
+		_, err := m.cli.RedactEvent(roomID, evID)
+		return "", err
+	})
+}
+
+// roomMembership reports whether the bot and the user are joined to the room.
+func roomMembership(cli *mautrix.Client, roomID id.RoomID, userID id.UserID) (botJoined bool, userJoined bool, err error) {
+	rooms, err := cli.JoinedRooms()
+	if err != nil {
+		return false, false, err
+	}
+
+	for _, joined := range rooms.JoinedRooms {
+		if joined == roomID {
+			botJoined = true
+			break
+		}
+	}
+	if !botJoined {
+		return false, false, nil
+	}
+
+	members, err := cli.JoinedMembers(roomID)
+	if err != nil {
+		return true, false, err
+	}
+
+	_, userJoined = members.Joined[userID]
+	return true, userJoined, nil
+}
+
+// sendReply sends a notice in reply to the event, in the thread of the event
+// if it was sent in one.
+func (m matrixBot) sendReply(inReplyTo *event.Event, msg string, msgF string) pendingMessage {
+	ev := event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    msg,
+	}
+	if msgF != "" {
+		ev.FormattedBody = msgF
+		ev.Format = event.FormatHTML
+	}
+	if thread := threadParent(inReplyTo.Content.AsMessage().RelatesTo); thread != "" {
+		return m.queue.enqueue(inReplyTo.RoomID, newThreadReply(ev, thread, inReplyTo.ID), false, m.sendMessageEvent)
+	}
+
+	ev.SetReply(inReplyTo)
+	return m.queue.enqueue(inReplyTo.RoomID, ev, false, m.sendMessageEvent)
+}
+
+// relThread is the relation of messages in a thread. mautrix v0.8.0 predates
+// threads, so they are handled here.
+const relThread event.RelationType = "m.thread"
+
+// threadParent gives the root of the thread the message with the relation
+// was sent in, or "" if it wasn't sent in a thread.
+func threadParent(rel *event.RelatesTo) id.EventID {
+	if rel == nil || rel.Type != relThread {
+		return ""
+	}
+	return rel.EventID
+}
+
+// threadReply is a message in a thread, replying to an event in it. Clients
+// without threads show it as a reply to the event.
+type threadReply struct {
+	event.MessageEventContent
+	RelatesTo threadRelation `json:"m.relates_to"`
+}
+
+type threadRelation struct {
+	Type          event.RelationType `json:"rel_type"`
+	EventID       id.EventID         `json:"event_id"`
+	InReplyTo     threadInReplyTo    `json:"m.in_reply_to"`
+	IsFallingBack bool               `json:"is_falling_back"`
+}
+
+type threadInReplyTo struct {
+	EventID id.EventID `json:"event_id"`
+}
+
+func newThreadReply(content event.MessageEventContent, thread id.EventID, inReplyTo id.EventID) threadReply {
+	content.RelatesTo = nil
+	return threadReply{
+		MessageEventContent: content,
+		RelatesTo: threadRelation{
+			Type:          relThread,
+			EventID:       thread,
+			InReplyTo:     threadInReplyTo{inReplyTo},
+			IsFallingBack: true,
+		},
+	}
 }
 
-func ignoreOldMessagesSyncHandler(resp *mautrix.RespSync, since string) bool {
+// ignoreFirstSyncHandler ignores the events of the very first sync, which
+// contains the history of the rooms. After restarts, syncing continues from
+// the stored sync token, so events sent while the bot was offline are handled.
+func ignoreFirstSyncHandler(resp *mautrix.RespSync, since string) bool {
 	return since != ""
 }
+
+func eventTime(ev *event.Event) time.Time {
+	return time.Unix(0, ev.Timestamp*int64(time.Millisecond))
+}
+
+// isTooOld reports whether the event was sent while the bot was offline,
+// longer than maxAge ago.
+func isTooOld(ev *event.Event, started time.Time, maxAge time.Duration) bool {
+	sent := eventTime(ev)
+	if !sent.Before(started) {
+		return false
+	}
+
+	if time.Since(sent) > maxAge {
+		fmt.Println("Ignoring event sent while offline:", ev.ID, sent)
+		return true
+	}
+
+	return false
+}
+
+// syncStore implements mautrix.SyncStore, storing the sync state in the database.
+type syncStore struct {
+	persist *sqlDB
+}
+
+func (s syncStore) SaveFilterID(userID id.UserID, filterID string) {
+	err := s.persist.updateSyncFilter(userID, filterID)
+	if err != nil {
+		fmt.Println("save filter ID:", err)
+	}
+}
+
+func (s syncStore) LoadFilterID(userID id.UserID) string {
+	filterID, _, err := s.persist.fetchSync(userID)
+	if err != nil {
+		fmt.Println("load filter ID:", err)
+	}
+	return filterID
+}
+
+func (s syncStore) SaveNextBatch(userID id.UserID, nextBatchToken string) {
+	err := s.persist.updateSyncToken(userID, nextBatchToken)
+	if err != nil {
+		fmt.Println("save sync token:", err)
+	}
+}
+
+func (s syncStore) LoadNextBatch(userID id.UserID) string {
+	_, nextBatch, err := s.persist.fetchSync(userID)
+	if err != nil {
+		fmt.Println("load sync token:", err)
+	}
+	return nextBatch
+}
+
+// SaveRoom doesn't store anything, as the bot keeps no room state from syncs.
+func (s syncStore) SaveRoom(room *mautrix.Room) {}
+
+func (s syncStore) LoadRoom(roomID id.RoomID) *mautrix.Room {
+	return nil
+}
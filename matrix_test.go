@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestThreadReply(t *testing.T) {
+	content := event.MessageEventContent{MsgType: event.MsgNotice, Body: "hi"}
+	data, err := json.Marshal(newThreadReply(content, "$root", "$command"))
+	assertEqual(t, err, nil, "thread reply can be encoded")
+
+	var parsed struct {
+		Body      string `json:"body"`
+		RelatesTo struct {
+			Type      string `json:"rel_type"`
+			EventID   string `json:"event_id"`
+			InReplyTo struct {
+				EventID string `json:"event_id"`
+			} `json:"m.in_reply_to"`
+			IsFallingBack bool `json:"is_falling_back"`
+		} `json:"m.relates_to"`
+	}
+	err = json.Unmarshal(data, &parsed)
+	assertEqual(t, err, nil, "thread reply can be decoded")
+	assertEqual(t, parsed.Body, "hi", "body is kept")
+	assertEqual(t, parsed.RelatesTo.Type, "m.thread", "message is sent in the thread")
+	assertEqual(t, parsed.RelatesTo.EventID, "$root", "thread root is referenced")
+	assertEqual(t, parsed.RelatesTo.InReplyTo.EventID, "$command", "fallback replies to the command")
+	assertEqual(t, parsed.RelatesTo.IsFallingBack, true, "reply is marked as fallback")
+
+	assertEqual(t, threadParent(&event.RelatesTo{Type: relThread, EventID: "$root"}), id.EventID("$root"), "thread root of a threaded message")
+	assertEqual(t, threadParent(nil), id.EventID(""), "message without relation isn't in a thread")
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var replyWelcome = cmdReply{
+	"Hi! I remind you of the events in your calendars and show you your schedule.\n\n" +
+		"To start, add a calendar by choosing a name, its type (caldav or ical) and its address:\n" +
+		"cal add personal caldav https://mysite.nl/calendar/3owevfu1d0rb3psw\n" +
+		"cal add work ical https://example.org/work.ics\n\n" +
+		"Then try 'today' or 'week' to view your schedule, 'timezone Europe/Amsterdam' to set your timezone, " +
+		"and 'help' to see everything I can do.",
+	"Hi! I remind you of the events in your calendars and show you your schedule.<br />\n<br />\n" +
+		"To start, add a calendar by choosing a name, its type (caldav or ical) and its address:<br />\n" +
+		"<code>cal add personal caldav https://mysite.nl/calendar/3owevfu1d0rb3psw</code><br />\n" +
+		"<code>cal add work ical https://example.org/work.ics</code><br />\n<br />\n" +
+		"Then try <code>today</code> or <code>week</code> to view your schedule, <code>timezone Europe/Amsterdam</code> to set your timezone, " +
+		"and <code>help</code> to see everything I can do.",
+}
+
+var replyDirectOnly = cmdReply{
+	"Sorry, I only work in direct chats. Please start a direct chat with me instead.",
+	"",
+}
+
+// handleInvite joins direct chats the bot is invited to, registering them as
+// the room of the user and welcoming the user. The bot leaves other rooms
+// after saying it only works in direct chats, unless group rooms are allowed.
+func handleInvite(cli *mautrix.Client, m matrixBot, cfg configMatrixBot, commands commandMatcher, data *store, ev *event.Event) {
+	direct := ev.Content.AsMember().IsDirect
+
+	if cfg.AdminRoom != "" && ev.RoomID == id.RoomID(cfg.AdminRoom) {
+		if !isAdmin(cfg.Admins, ev.Sender) {
+			fmt.Println("Declining invite to the admin room by non-admin:", ev.Sender)
+			_, err := cli.LeaveRoom(ev.RoomID)
+			if err != nil {
+				fmt.Println(err)
+			}
+			return
+		}
+
+		_, err := cli.JoinRoom(ev.RoomID.String(), "", nil)
+		if err != nil {
+			fmt.Println(err)
+		}
+		return
+	}
+
+	_, err := cli.JoinRoom(ev.RoomID.String(), "", nil)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	if !direct && !cfg.GroupRooms {
+		// Joined only to tell why the bot leaves again, which can't be done
+		// by declining the invite.
+		fmt.Println("Leaving non-direct room:", ev.RoomID, ev.Sender)
+
+		_, err = m.sendNotice(ev.RoomID, replyDirectOnly.msg, replyDirectOnly.msgF).wait()
+		if err != nil {
+			fmt.Println(err)
+		}
+		_, err = cli.LeaveRoom(ev.RoomID)
+		if err != nil {
+			fmt.Println(err)
+		}
+		return
+	}
+
+	if !direct {
+		_, err = data.addGroupRoom(ev.RoomID)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		welcome := formatWelcomeGroup(commands.prefix())
+		m.sendNotice(ev.RoomID, welcome.msg, welcome.msgF).logFailure("welcome")
+		return
+	}
+
+	u, err := data.user(ev.Sender)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	replies := []cmdReply{replyWelcome}
+
+	switch {
+	case !u.ExistsInDB():
+		err = u.store(ev.RoomID)
+		if err == nil {
+			u.startReminders()
+		}
+	case u.hasLeft():
+		err = u.storeRoomID(ev.RoomID)
+		if err == nil {
+			err = data.userReturned(u)
+		}
+	default:
+		// The user keeps getting reminders in their current room, until
+		// choosing this one.
+		_, err = u.addRoom(ev.RoomID)
+		replies = append(replies, formatOtherRoom(u.RoomID()))
+	}
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	for _, reply := range replies {
+		m.sendNotice(ev.RoomID, reply.msg, reply.msgF).logFailure("welcome")
+	}
+}
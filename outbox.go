@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	// maxSendAttempts is how often sending a message is tried before giving
+	// up and marking it as failed.
+	maxSendAttempts = 8
+	maxSendDelay    = 5 * time.Minute
+
+	// maxOutboxAge is the age up to which undelivered messages are still
+	// sent after a restart, as reminders are useless once outdated.
+	maxOutboxAge = time.Hour
+
+	// roomQueueSize is how many messages can wait to be sent to a room,
+	// roomQueueIdle how long the queue of a room is kept without messages.
+	roomQueueSize = 100
+	roomQueueIdle = 10 * time.Minute
+)
+
+// errQueueFull is returned for messages to rooms which have too many
+// messages waiting already, like while the homeserver is unavailable.
+var errQueueFull = errors.New("too many messages are waiting to be sent to the room")
+
+// outboundMessage is a message waiting to be sent.
+type outboundMessage struct {
+	send func() (id.EventID, error)
+
+	// dbID is the ID of the message in the outbox table, 0 if the message
+	// isn't persisted.
+	dbID int64
+
+	result chan sendResult
+}
+
+type sendResult struct {
+	evID id.EventID
+	err  error
+}
+
+// pendingMessage gives the result of a queued message once it was sent or
+// sending it failed. Callers only wait for it when they need the result.
+type pendingMessage <-chan sendResult
+
+// wait blocks until the message was sent, returning the ID of the event.
+func (p pendingMessage) wait() (id.EventID, error) {
+	res := <-p
+	return res.evID, res.err
+}
+
+// logFailure prints the error if sending the message fails, without waiting
+// for it.
+func (p pendingMessage) logFailure(what string) {
+	go func() {
+		_, err := p.wait()
+		if err != nil {
+			fmt.Println(what+":", err)
+		}
+	}()
+}
+
+// outboundQueue sends the messages to each room one at a time, retrying them
+// when the homeserver is unavailable or rate limits the bot. Rooms have
+// queues of their own, so retries in one room don't hold up the others.
+// Scheduled messages like reminders are persisted until they are sent, so
+// they survive restarts.
+type outboundQueue struct {
+	persist *sqlDB
+
+	mutex sync.Mutex
+	rooms map[id.RoomID]chan *outboundMessage
+
+	baseDelay time.Duration
+	queueSize int
+	idle      time.Duration
+}
+
+func newOutboundQueue(persist *sqlDB) *outboundQueue {
+	return &outboundQueue{
+		persist:   persist,
+		rooms:     make(map[id.RoomID]chan *outboundMessage),
+		baseDelay: time.Second,
+		queueSize: roomQueueSize,
+		idle:      roomQueueIdle,
+	}
+}
+
+// enqueue sends the message once the messages before it to the same room are
+// sent. Durable messages are stored in the outbox until they are sent. It
+// doesn't block: when the queue of the room is full, sending fails right away.
+func (q *outboundQueue) enqueue(roomID id.RoomID, content interface{}, durable bool, send func(id.RoomID, interface{}) (id.EventID, error)) pendingMessage {
+	msg := &outboundMessage{
+		send:   func() (id.EventID, error) { return send(roomID, content) },
+		result: make(chan sendResult, 1),
+	}
+
+	if durable {
+		data, err := json.Marshal(content)
+		if err != nil {
+			msg.result <- sendResult{"", err}
+			return msg.result
+		}
+
+		msg.dbID, err = q.persist.addOutboxMessage(roomID, string(data))
+		if err != nil {
+			// The message can still be sent, it's just not persisted.
+			fmt.Println("outbox:", err)
+		}
+	}
+
+	q.add(roomID, msg)
+	return msg.result
+}
+
+// add puts the message in the queue of the room, starting the queue if the
+// room has none. Messages which don't fit are failed.
+func (q *outboundQueue) add(roomID id.RoomID, msg *outboundMessage) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	queue, ok := q.rooms[roomID]
+	if !ok {
+		queue = make(chan *outboundMessage, q.queueSize)
+		q.rooms[roomID] = queue
+		go q.run(roomID, queue)
+	}
+
+	select {
+	case queue <- msg:
+	default:
+		fmt.Println("Sending message failed:", roomID, errQueueFull)
+		q.failed(msg, 0, errQueueFull)
+		msg.result <- sendResult{"", errQueueFull}
+	}
+}
+
+// run sends the messages in the queue of the room. The queue is removed once
+// it has been empty for a while, so rooms which aren't used anymore don't
+// keep their queue.
+func (q *outboundQueue) run(roomID id.RoomID, queue chan *outboundMessage) {
+	for {
+		select {
+		case msg := <-queue:
+			evID, err := q.deliver(msg)
+			msg.result <- sendResult{evID, err}
+		case <-time.After(q.idle):
+			// Messages are only added while holding the mutex, so none can
+			// arrive after the check.
+			q.mutex.Lock()
+			if len(queue) == 0 {
+				delete(q.rooms, roomID)
+				q.mutex.Unlock()
+				return
+			}
+			q.mutex.Unlock()
+		}
+	}
+}
+
+// deliver sends the message, retrying after temporary failures.
+func (q *outboundQueue) deliver(msg *outboundMessage) (id.EventID, error) {
+	var err error
+	for attempt := 0; attempt < maxSendAttempts; attempt++ {
+		var evID id.EventID
+		evID, err = msg.send()
+		if err == nil {
+			q.delivered(msg)
+			return evID, nil
+		}
+
+		delay, temporary := retryDelay(err, attempt, q.baseDelay)
+		if !temporary {
+			fmt.Println("Sending message failed permanently:", err)
+			q.failed(msg, attempt+1, err)
+			return "", err
+		}
+
+		fmt.Printf("Sending message failed, retrying in %s: %s\n", delay, err)
+		<-time.After(delay)
+	}
+
+	fmt.Println("Sending message failed, giving up:", err)
+	q.failed(msg, maxSendAttempts, err)
+	return "", err
+}
+
+func (q *outboundQueue) delivered(msg *outboundMessage) {
+	if msg.dbID == 0 {
+		return
+	}
+
+	err := q.persist.removeOutboxMessage(msg.dbID)
+	if err != nil {
+		fmt.Println("outbox:", err)
+	}
+}
+
+// failed marks the persisted message as failed, recording the error for the
+// operator.
+func (q *outboundQueue) failed(msg *outboundMessage, attempts int, sendErr error) {
+	if msg.dbID == 0 {
+		return
+	}
+
+	err := q.persist.updateOutboxFailure(msg.dbID, attempts, sendErr.Error(), true)
+	if err != nil {
+		fmt.Println("outbox:", err)
+	}
+}
+
+// resendPending queues the messages which weren't sent before the last
+// restart. Outdated messages are marked as failed instead.
+func (q *outboundQueue) resendPending(send func(id.RoomID, interface{}) (id.EventID, error)) {
+	pending, err := q.persist.fetchPendingOutbox()
+	if err != nil {
+		fmt.Println("outbox:", err)
+		return
+	}
+
+	for _, p := range pending {
+		if time.Since(p.created) > maxOutboxAge {
+			err = q.persist.updateOutboxFailure(p.dbID, p.attempts, "expired", true)
+			if err != nil {
+				fmt.Println("outbox:", err)
+			}
+			continue
+		}
+
+		roomID, content := p.roomID, json.RawMessage(p.content)
+		q.add(roomID, &outboundMessage{
+			send:   func() (id.EventID, error) { return send(roomID, content) },
+			dbID:   p.dbID,
+			result: make(chan sendResult, 1),
+		})
+	}
+
+	if len(pending) > 0 {
+		fmt.Printf("Resending %d undelivered messages\n", len(pending))
+	}
+}
+
+// retryDelay gives how long to wait before trying to send again after the
+// error, and whether trying again makes sense at all. Rate limits are
+// honoured, and other errors from the homeserver except server errors are
+// permanent.
+func retryDelay(err error, attempt int, baseDelay time.Duration) (time.Duration, bool) {
+	var httpErr mautrix.HTTPError
+	if errors.As(err, &httpErr) && httpErr.RespError != nil {
+		status := 0
+		if httpErr.Response != nil {
+			status = httpErr.Response.StatusCode
+		}
+
+		switch {
+		case httpErr.RespError.ErrCode == "M_LIMIT_EXCEEDED":
+			// mautrix v0.8.0 leaves retry_after_ms in the extra data.
+			if ms, _ := httpErr.RespError.ExtraData["retry_after_ms"].(float64); ms > 0 {
+				return time.Duration(ms) * time.Millisecond, true
+			}
+		case status != 0 && status < 500:
+			return 0, false
+		}
+	}
+
+	delay := baseDelay << uint(attempt)
+	if delay > maxSendDelay {
+		delay = maxSendDelay
+	}
+	return delay, true
+}
+
+// outboxMessage is an undelivered message stored in the outbox table.
+type outboxMessage struct {
+	dbID     int64
+	roomID   id.RoomID
+	content  string
+	created  time.Time
+	attempts int
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestRetryDelay(t *testing.T) {
+	httpErr := func(status int, errCode string, retryAfterMs int) error {
+		respErr := &mautrix.RespError{ErrCode: errCode, ExtraData: map[string]interface{}{}}
+		if retryAfterMs > 0 {
+			// Numbers are decoded as float64 from the JSON response.
+			respErr.ExtraData["retry_after_ms"] = float64(retryAfterMs)
+		}
+		req, _ := http.NewRequest(http.MethodPut, "https://example.org/_matrix/client/r0/rooms/!room:example.org/send", nil)
+		return mautrix.HTTPError{
+			Request:   req,
+			Response:  &http.Response{StatusCode: status},
+			RespError: respErr,
+		}
+	}
+
+	var tests = []struct {
+		err     error
+		attempt int
+
+		expect          time.Duration
+		expectTemporary bool
+	}{
+		{httpErr(429, "M_LIMIT_EXCEEDED", 2500), 0, 2500 * time.Millisecond, true},
+		{httpErr(429, "M_LIMIT_EXCEEDED", 0), 2, 4 * time.Second, true},
+		{httpErr(502, "M_UNKNOWN", 0), 1, 2 * time.Second, true},
+		{httpErr(403, "M_FORBIDDEN", 0), 0, 0, false},
+		{errors.New("connection refused"), 0, time.Second, true},
+		{errors.New("connection refused"), 20, maxSendDelay, true},
+	}
+
+	for _, test := range tests {
+		delay, temporary := retryDelay(test.err, test.attempt, time.Second)
+		assertEqual(t, temporary, test.expectTemporary, "error is temporary: "+test.err.Error())
+		assertEqual(t, delay, test.expect, "retry delay for: "+test.err.Error())
+	}
+}
+
+func TestOutboundQueueRetries(t *testing.T) {
+	q := newOutboundQueue(nil)
+	q.baseDelay = time.Millisecond
+
+	attempts := 0
+	send := func(roomID id.RoomID, content interface{}) (id.EventID, error) {
+		attempts++
+		if attempts < 3 {
+			return "", errors.New("connection refused")
+		}
+		return "$sent", nil
+	}
+
+	evID, err := q.enqueue("!room:example.org", "hi", false, send).wait()
+	assertEqual(t, err, nil, "message is sent after retrying")
+	assertEqual(t, evID, id.EventID("$sent"), "ID of the sent event is returned")
+	assertEqual(t, attempts, 3, "message is tried until it is sent")
+
+	req, _ := http.NewRequest(http.MethodPut, "https://example.org/_matrix/client/r0/rooms/!room:example.org/send", nil)
+	forbidden := mautrix.HTTPError{
+		Request:   req,
+		Response:  &http.Response{StatusCode: 403},
+		RespError: &mautrix.RespError{ErrCode: "M_FORBIDDEN"},
+	}
+	attempts = 0
+	_, err = q.enqueue("!room:example.org", "hi", false, func(id.RoomID, interface{}) (id.EventID, error) {
+		attempts++
+		return "", forbidden
+	}).wait()
+	assertEqual(t, err != nil, true, "permanent failure is returned")
+	assertEqual(t, attempts, 1, "permanent failure isn't retried")
+}
+
+func TestOutboundQueueRooms(t *testing.T) {
+	q := newOutboundQueue(nil)
+
+	release := make(chan struct{})
+	blocked := q.enqueue("!slow:example.org", "hi", false, func(id.RoomID, interface{}) (id.EventID, error) {
+		<-release
+		return "$slow", nil
+	})
+
+	evID, err := q.enqueue("!other:example.org", "hi", false, func(id.RoomID, interface{}) (id.EventID, error) {
+		return "$other", nil
+	}).wait()
+	assertEqual(t, err, nil, "message to another room is sent")
+	assertEqual(t, evID, id.EventID("$other"), "other room isn't held up by a slow room")
+
+	close(release)
+	evID, _ = blocked.wait()
+	assertEqual(t, evID, id.EventID("$slow"), "slow room is sent once released")
+}
+
+func TestOutboundQueueFull(t *testing.T) {
+	q := newOutboundQueue(nil)
+	q.queueSize = 1
+
+	release := make(chan struct{})
+	slow := func(id.RoomID, interface{}) (id.EventID, error) {
+		<-release
+		return "$slow", nil
+	}
+
+	sending := q.enqueue("!slow:example.org", "first", false, slow)
+	// Wait until the first message is being sent, so the second one fills
+	// the queue.
+	for {
+		q.mutex.Lock()
+		waiting := len(q.rooms["!slow:example.org"])
+		q.mutex.Unlock()
+		if waiting == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	queued := q.enqueue("!slow:example.org", "second", false, slow)
+
+	_, err := q.enqueue("!slow:example.org", "third", false, slow).wait()
+	assertEqual(t, err, errQueueFull, "message to a full queue fails without blocking")
+
+	close(release)
+	_, err = sending.wait()
+	assertEqual(t, err, nil, "message being sent is sent")
+	_, err = queued.wait()
+	assertEqual(t, err, nil, "queued message is sent")
+}
+
+func TestOutboundQueueIdle(t *testing.T) {
+	q := newOutboundQueue(nil)
+	q.idle = time.Millisecond
+
+	send := func(id.RoomID, interface{}) (id.EventID, error) {
+		return "$sent", nil
+	}
+	_, err := q.enqueue("!room:example.org", "hi", false, send).wait()
+	assertEqual(t, err, nil, "message is sent")
+
+	for i := 0; i < 1000; i++ {
+		q.mutex.Lock()
+		rooms := len(q.rooms)
+		q.mutex.Unlock()
+		if rooms == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	q.mutex.Lock()
+	assertEqual(t, len(q.rooms), 0, "idle queue is removed")
+	q.mutex.Unlock()
+
+	evID, err := q.enqueue("!room:example.org", "hi again", false, send).wait()
+	assertEqual(t, err == nil && evID == "$sent", true, "queue is started again for new messages")
+}
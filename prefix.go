@@ -0,0 +1,107 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"strings"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// defaultCommandPrefixes start commands outside of direct chats, unless
+// configured otherwise.
+var defaultCommandPrefixes = []string{"!cal"}
+
+// commandMatcher recognises commands in messages outside of direct chats,
+// which start with a command prefix or a mention of the bot.
+type commandMatcher struct {
+	us       id.UserID
+	prefixes []string
+}
+
+func newCommandMatcher(us id.UserID, prefixes []string) commandMatcher {
+	if len(prefixes) == 0 {
+		prefixes = defaultCommandPrefixes
+	}
+	return commandMatcher{us, prefixes}
+}
+
+// prefix gives the prefix to show in examples.
+func (c commandMatcher) prefix() string {
+	return c.prefixes[0]
+}
+
+// match gives the command in the message, if it is one. A prefix or mention
+// without command is taken as asking for help.
+func (c commandMatcher) match(content *event.MessageEventContent) (string, bool) {
+	str, ok := c.matchPill(content.FormattedBody)
+	if !ok {
+		str, ok = c.matchPrefix(content.Body)
+	}
+	if !ok {
+		return "", false
+	}
+
+	if str == "" {
+		str = "help"
+	}
+	return str, true
+}
+
+// matchPrefix matches messages starting with a prefix, the ID of the bot or
+// the name of the bot, like "!cal week" and "calendarbot: week".
+func (c commandMatcher) matchPrefix(body string) (string, bool) {
+	body = strings.TrimSpace(body)
+
+	prefixes := append(append([]string{}, c.prefixes...), string(c.us), localpart(c.us))
+
+	for _, prefix := range prefixes {
+		if len(body) < len(prefix) || !strings.EqualFold(body[:len(prefix)], prefix) {
+			continue
+		}
+
+		rest := body[len(prefix):]
+		if rest != "" && rest[0] != ' ' && rest[0] != ':' && rest[0] != ',' {
+			// Like "!calendar", which doesn't start with the prefix "!cal".
+			continue
+		}
+
+		return strings.TrimSpace(strings.TrimLeft(rest, ":,")), true
+	}
+
+	return "", false
+}
+
+var (
+	pillPattern = regexp.MustCompile(`^\s*<a href="https://matrix\.to/#/([^"]+)">.*?</a>`)
+	tagPattern  = regexp.MustCompile(`<[^>]*>`)
+)
+
+// matchPill matches formatted messages starting with a mention pill of the
+// bot, whose plain body contains the display name of the bot instead.
+func (c commandMatcher) matchPill(formattedBody string) (string, bool) {
+	m := pillPattern.FindStringSubmatch(formattedBody)
+	if m == nil || id.UserID(m[1]) != c.us {
+		return "", false
+	}
+
+	rest := formattedBody[len(m[0]):]
+	rest = html.UnescapeString(tagPattern.ReplaceAllString(rest, ""))
+
+	return strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(rest), ":,")), true
+}
+
+// localpart gives the part of the user ID before the server name, like
+// "calendarbot" for @calendarbot:example.org.
+func localpart(userID id.UserID) string {
+	return strings.SplitN(strings.TrimPrefix(string(userID), "@"), ":", 2)[0]
+}
+
+// isDirectChat reports whether the room is a stored direct chat between the
+// bot and the sender, in which every message is a command. Other rooms, like
+// ones the bot was added to without an invite, need a prefix or mention.
+func isDirectChat(data *store, sender id.UserID, roomID id.RoomID) bool {
+	u := data.userInRoom(roomID)
+	return u != nil && u.userID == sender
+}
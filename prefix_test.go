@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestCommandMatcher(t *testing.T) {
+	commands := newCommandMatcher("@calendarbot:example.org", nil)
+
+	var tests = []struct {
+		body, formattedBody string
+
+		expect   string
+		expectOk bool
+	}{
+		{"!cal week", "", "week", true},
+		{"!CAL today", "", "today", true},
+		{"!cal", "", "help", true},
+		{"calendarbot: cal list", "", "cal list", true},
+		{"@calendarbot:example.org next week", "", "next week", true},
+		{"Calendar Bot: week", `<a href="https://matrix.to/#/@calendarbot:example.org">Calendar Bot</a>: week`, "week", true},
+		{"Calendar Bot", `<a href="https://matrix.to/#/@calendarbot:example.org">Calendar Bot</a>`, "help", true},
+		{"Alice: week", `<a href="https://matrix.to/#/@alice:example.org">Alice</a>: week`, "", false},
+		{"!calendar week", "", "", false},
+		{"what's on the calendar?", "", "", false},
+		{"week", "", "", false},
+	}
+
+	for _, test := range tests {
+		got, ok := commands.match(&event.MessageEventContent{Body: test.body, FormattedBody: test.formattedBody})
+		assertEqual(t, ok, test.expectOk, "command is recognised in "+test.body)
+		assertEqual(t, got, test.expect, "command is extracted from "+test.body)
+	}
+
+	commands = newCommandMatcher(id.UserID("@calendarbot:example.org"), []string{"!agenda", "."})
+	got, ok := commands.match(&event.MessageEventContent{Body: ". week"})
+	assertEqual(t, ok, true, "configured prefix is recognised")
+	assertEqual(t, got, "week", "command is extracted after configured prefix")
+	_, ok = commands.match(&event.MessageEventContent{Body: "!cal week"})
+	assertEqual(t, ok, false, "default prefix is replaced by configured prefixes")
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	// loadingThreshold is how long a command may take before the user is told
+	// it's still loading.
+	loadingThreshold = 3 * time.Second
+	typingTimeout    = 30 * time.Second
+)
+
+// commandProgress shows the user a command is being handled: the command is
+// marked as read and the bot is shown typing. Slow commands get a notice that
+// they're still loading, which is edited into the reply once done.
+type commandProgress struct {
+	m  matrixBot
+	ev *event.Event
+
+	mutex     sync.Mutex
+	timer     *time.Timer
+	loadingID id.EventID
+	finished  bool
+}
+
+func (m matrixBot) newCommandProgress(ev *event.Event) *commandProgress {
+	return &commandProgress{m: m, ev: ev}
+}
+
+// start is called once the message turned out to be a command.
+func (p *commandProgress) start() {
+	err := p.m.cli.MarkRead(p.ev.RoomID, p.ev.ID)
+	if err != nil {
+		fmt.Println("read receipt:", p.ev.ID, err)
+	}
+
+	p.setTyping(true)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.timer = time.AfterFunc(loadingThreshold, p.sendLoading)
+}
+
+func (p *commandProgress) sendLoading() {
+	p.mutex.Lock()
+	finished := p.finished
+	p.mutex.Unlock()
+	if finished {
+		return
+	}
+
+	// The mutex isn't held while sending, so finishing isn't held up.
+	evID, err := p.m.sendReply(p.ev, "Still loading…", "").wait()
+	if err != nil {
+		fmt.Println("loading notice:", p.ev.ID, err)
+		return
+	}
+
+	p.mutex.Lock()
+	finished = p.finished
+	if !finished {
+		p.loadingID = evID
+	}
+	p.mutex.Unlock()
+
+	if finished {
+		// The replies were sent in the meantime, without replacing this notice.
+		p.m.redactMessage(p.ev.RoomID, evID).logFailure("redact loading notice " + evID.String())
+	}
+}
+
+// finish sends the replies to the command, replacing the loading notice if
+// one was sent. The result gives the ID of the message holding the replies,
+// it is nil when there are no replies.
+func (p *commandProgress) finish(replies []cmdReply) pendingMessage {
+	p.mutex.Lock()
+	p.finished = true
+	started := p.timer != nil
+	if started {
+		p.timer.Stop()
+	}
+	loadingID := p.loadingID
+	p.mutex.Unlock()
+
+	if started {
+		p.setTyping(false)
+	}
+
+	if len(replies) == 0 {
+		if loadingID != "" {
+			p.m.redactMessage(p.ev.RoomID, loadingID).logFailure("redact loading notice " + loadingID.String())
+		}
+		return nil
+	}
+
+	reply := joinReplies(replies)
+	if loadingID == "" {
+		return p.m.sendReply(p.ev, reply.msg, reply.msgF)
+	}
+
+	edit := p.m.editMatrixMessage(p.ev.RoomID, loadingID, reply.msg, reply.msgF, event.MsgNotice)
+	result := make(chan sendResult, 1)
+	go func() {
+		_, err := edit.wait()
+		if err == nil {
+			result <- sendResult{loadingID, nil}
+			return
+		}
+		fmt.Println("edit loading notice:", loadingID, err)
+
+		evID, err := p.m.sendReply(p.ev, reply.msg, reply.msgF).wait()
+		result <- sendResult{evID, err}
+	}()
+	return result
+}
+
+func (p *commandProgress) setTyping(typing bool) {
+	_, err := p.m.cli.UserTyping(p.ev.RoomID, typing, typingTimeout.Milliseconds())
+	if err != nil {
+		fmt.Println("typing:", p.ev.RoomID, err)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// quietSettings configures when a user doesn't want to receive reminders.
+type quietSettings struct {
+	// Daily quiet hours, from the from time of day until the to time of day.
+	enabled  bool
+	from, to timeOfDay
+
+	// No reminders at all until this time, if set.
+	pausedUntil time.Time
+
+	// Whether reminders during quiet times are sent in a single message
+	// afterwards, instead of being dropped.
+	batch bool
+}
+
+// inQuietHours reports whether the time falls in the daily quiet hours.
+func (q quietSettings) inQuietHours(t time.Time, loc *time.Location) bool {
+	if !q.enabled {
+		return false
+	}
+
+	t = t.In(loc)
+	minute := t.Hour()*60 + t.Minute()
+	from := q.from.hour*60 + q.from.minute
+	to := q.to.hour*60 + q.to.minute
+
+	if from <= to {
+		return from <= minute && minute < to
+	}
+
+	// The quiet hours span midnight.
+	return minute >= from || minute < to
+}
+
+// quietUntil gives the end of the quiet time the given time falls in.
+// quiet is false if the time isn't in a quiet time.
+func (q quietSettings) quietUntil(t time.Time, loc *time.Location) (until time.Time, quiet bool) {
+	until = t
+
+	// Pauses and quiet hours can directly follow each other.
+	for i := 0; i < 3; i++ {
+		if q.pausedUntil.After(until) {
+			until = q.pausedUntil
+			quiet = true
+			continue
+		}
+
+		if q.inQuietHours(until, loc) {
+			until = q.to.nextDaily(until, loc)
+			quiet = true
+			continue
+		}
+
+		break
+	}
+
+	return until, quiet
+}
+
+// reminderBatch collects the reminders withheld during quiet times.
+type reminderBatch struct {
+	mutex  sync.Mutex
+	events []*calendarEvent
+	timer  *time.Timer
+}
+
+// add adds the event to the batch. The first event added schedules flush at
+// the given time.
+func (b *reminderBatch) add(ev *calendarEvent, at time.Time, flush func([]*calendarEvent)) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, batched := range b.events {
+		if batched.key() == ev.key() {
+			return
+		}
+	}
+
+	b.events = append(b.events, ev)
+
+	if b.timer != nil {
+		return
+	}
+
+	b.timer = time.AfterFunc(time.Until(at), func() {
+		b.mutex.Lock()
+		events := b.events
+		b.events = nil
+		b.timer = nil
+		b.mutex.Unlock()
+
+		flush(events)
+	})
+}
+
+func (u *user) setQuiet(qs quietSettings) error {
+	u.mutex.RLock()
+	userID := u.userID
+	u.mutex.RUnlock()
+
+	err := u.persist.updateUserQuiet(userID, qs)
+	if err != nil {
+		return err
+	}
+
+	u.mutex.Lock()
+	u.quiet = qs
+	u.mutex.Unlock()
+
+	return nil
+}
+
+func (u *user) quietSettings() quietSettings {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	return u.quiet
+}
+
+// remind sends the reminders, unless the user is in a quiet time. The reminders
+// are then either dropped or batched, depending on the settings of the user.
+func (u *user) remind(rems []reminder) {
+	qs := u.quietSettings()
+
+	until, quiet := qs.quietUntil(time.Now(), u.location())
+	if !quiet {
+		u.sendReminderMessage(rems)
+		return
+	}
+
+	for _, rem := range rems {
+		if !qs.batch {
+			fmt.Println("Reminder suppressed during quiet time for:", rem.event.text)
+			continue
+		}
+
+		u.quietBatch.add(rem.event, until, u.sendBatchedReminders)
+	}
+}
+
+// sendBatchedReminders sends the reminders withheld during a quiet time in a
+// single message per room, like other reminders.
+func (u *user) sendBatchedReminders(evs []*calendarEvent) {
+	if len(evs) == 0 {
+		return
+	}
+
+	evs = calendarEvents(evs).in(u.location())
+	sort.Sort(calendarEvents(evs))
+
+	rooms := []id.RoomID{}
+	byRoom := make(map[id.RoomID][]*calendarEvent)
+
+	for _, ev := range evs {
+		roomID := u.roomFor(ev)
+		if _, ok := byRoom[roomID]; !ok {
+			rooms = append(rooms, roomID)
+		}
+		byRoom[roomID] = append(byRoom[roomID], ev)
+	}
+
+	for _, roomID := range rooms {
+		lines := []string{"Reminders from while you were not disturbed:"}
+		linesF := []string{"<b>Reminders from while you were not disturbed:</b>"}
+
+		for _, ev := range byRoom[roomID] {
+			when := ev.from.Format("Monday 2 January 15:04")
+			lines = append(lines, fmt.Sprintf("%s: %s", when, ev.text))
+			linesF = append(linesF, fmt.Sprintf("<code>%s</code>: %s", when, html.EscapeString(ev.text)))
+		}
+
+		_, err := u.messageSender().sendMessage(roomID, strings.Join(lines, "\n"), strings.Join(linesF, "<br />"), true).wait()
+		if err != nil {
+			fmt.Println("batched reminders:", u.userID, err)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuietSettingsQuietUntil(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Amsterdam")
+	if err != nil {
+		t.Error(err)
+	}
+
+	night := quietSettings{enabled: true, from: timeOfDay{22, 0}, to: timeOfDay{7, 0}}
+	lunch := quietSettings{enabled: true, from: timeOfDay{12, 0}, to: timeOfDay{13, 0}}
+	paused := night
+	paused.pausedUntil = time.Date(2020, 11, 20, 0, 0, 0, 0, loc)
+
+	var tests = []struct {
+		qs quietSettings
+		t  time.Time
+
+		expectQuiet bool
+		expectUntil time.Time
+	}{
+		{
+			night,
+			time.Date(2020, 11, 9, 12, 0, 0, 0, loc),
+			false, time.Time{},
+		},
+		{
+			night,
+			time.Date(2020, 11, 9, 23, 0, 0, 0, loc),
+			true, time.Date(2020, 11, 10, 7, 0, 0, 0, loc),
+		},
+		{
+			night,
+			time.Date(2020, 11, 10, 6, 59, 0, 0, loc),
+			true, time.Date(2020, 11, 10, 7, 0, 0, 0, loc),
+		},
+		{
+			night,
+			time.Date(2020, 11, 10, 7, 0, 0, 0, loc),
+			false, time.Time{},
+		},
+		{
+			lunch,
+			time.Date(2020, 11, 9, 12, 30, 0, 0, loc),
+			true, time.Date(2020, 11, 9, 13, 0, 0, 0, loc),
+		},
+		{
+			lunch,
+			time.Date(2020, 11, 9, 23, 0, 0, 0, loc),
+			false, time.Time{},
+		},
+		{
+			// The pause ends during the quiet hours.
+			paused,
+			time.Date(2020, 11, 15, 12, 0, 0, 0, loc),
+			true, time.Date(2020, 11, 20, 7, 0, 0, 0, loc),
+		},
+	}
+
+	for _, test := range tests {
+		until, quiet := test.qs.quietUntil(test.t, loc)
+		if quiet != test.expectQuiet {
+			t.Errorf("at %s expected quiet: %t, got: %t", test.t, test.expectQuiet, quiet)
+			continue
+		}
+		if quiet {
+			assertTimeEquals(t, test.expectUntil, until)
+		}
+	}
+}
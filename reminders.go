@@ -3,25 +3,55 @@ package main
 import (
 	"fmt"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
+
+	"maunium.net/go/mautrix/id"
 )
 
 type reminderTimer struct {
-	send func(*calendarEvent)
+	send func([]reminder)
 
 	forDuration time.Duration
 
 	reminderTimes []time.Duration
 
+	// endReminderTimes are the times before the end of events to remind at.
+	endReminderTimes []time.Duration
+	allDay           allDayReminder
+	loc              *time.Location
+
 	cal queryableCalendar
 
+	// scheduled are the reminders the running loop sends.
+	scheduled []reminder
+
 	stopTimer      chan struct{}
 	stopTimerMutex sync.Mutex
 }
 
-func newReminderTimer(send func(*calendarEvent), forDuration time.Duration, cal queryableCalendar, reminderTimes []time.Duration) reminderTimer {
-	return reminderTimer{
+// allDayReminder configures at which time all-day events are announced. When
+// not enabled, they are reminded of like other events.
+type allDayReminder struct {
+	enabled   bool
+	at        timeOfDay
+	dayBefore bool
+}
+
+// time gives the time at which the all-day event is announced, in loc.
+func (a allDayReminder) time(ev *calendarEvent, loc *time.Location) time.Time {
+	day := ev.from.Day()
+	if a.dayBefore {
+		day--
+	}
+
+	return time.Date(ev.from.Year(), ev.from.Month(), day, a.at.hour, a.at.minute, 0, 0, loc)
+}
+
+func newReminderTimer(send func([]reminder), forDuration time.Duration, cal queryableCalendar, reminderTimes []time.Duration) *reminderTimer {
+	return &reminderTimer{
 		send:          send,
 		forDuration:   forDuration,
 		reminderTimes: reminderTimes,
@@ -29,6 +59,17 @@ func newReminderTimer(send func(*calendarEvent), forDuration time.Duration, cal
 	}
 }
 
+// configure sets the reminders before the end of events, and when all-day
+// events are announced in loc. They are used from the next call of set.
+func (t *reminderTimer) configure(endReminderTimes []time.Duration, allDay allDayReminder, loc *time.Location) {
+	t.stopTimerMutex.Lock()
+	defer t.stopTimerMutex.Unlock()
+
+	t.endReminderTimes = endReminderTimes
+	t.allDay = allDay
+	t.loc = loc
+}
+
 func (t *reminderTimer) set() error {
 	reminders, err := t.createReminders()
 	if err != nil {
@@ -43,32 +84,95 @@ func (t *reminderTimer) set() error {
 	}
 
 	t.stopTimer = make(chan struct{}, 1)
+	t.scheduled = reminders
 
 	go reminderLoop(reminders, t.stopTimer, t.send)
 
 	return nil
 }
 
+// stop stops sending the scheduled reminders.
+func (t *reminderTimer) stop() {
+	t.stopTimerMutex.Lock()
+	defer t.stopTimerMutex.Unlock()
+
+	if t.stopTimer != nil {
+		t.stopTimer <- struct{}{}
+		t.stopTimer = nil
+	}
+	t.scheduled = nil
+}
+
+// upcoming gives the scheduled reminders which haven't been sent yet.
+func (t *reminderTimer) upcoming() []reminder {
+	t.stopTimerMutex.Lock()
+	defer t.stopTimerMutex.Unlock()
+
+	upcoming := []reminder{}
+	now := time.Now()
+	for _, rem := range t.scheduled {
+		if rem.when.After(now) {
+			upcoming = append(upcoming, rem)
+		}
+	}
+
+	return upcoming
+}
+
+// setCalendar replaces the calendar the reminders are created for, used from
+// the next call of set.
+func (t *reminderTimer) setCalendar(cal queryableCalendar) {
+	t.stopTimerMutex.Lock()
+	defer t.stopTimerMutex.Unlock()
+	t.cal = cal
+}
+
 func (t *reminderTimer) createReminders() ([]reminder, error) {
-	evs, err := t.cal.eventsBetween(time.Now(), time.Now().Add(t.forDuration).Add(t.highestReminderTime()))
+	t.stopTimerMutex.Lock()
+	cal := t.cal
+	endReminderTimes := t.endReminderTimes
+	allDay := t.allDay
+	loc := t.loc
+	t.stopTimerMutex.Unlock()
+
+	if loc == nil {
+		loc = time.Local
+	}
+
+	now := time.Now()
+	until := now.Add(t.forDuration).Add(t.highestReminderTime())
+
+	// Events in progress can still end, and all-day events can be announced
+	// the day before.
+	evs, err := cal.eventsBetween(now.Add(-24*time.Hour), until.Add(24*time.Hour))
 	if err != nil {
 		return []reminder{}, err
 	}
 
 	rems := []reminder{}
 
+	add := func(when time.Time, ev *calendarEvent, kind reminderKind) {
+		if now.Before(when) && !when.After(until) {
+			rems = append(rems, reminder{when: when, event: ev, kind: kind})
+		}
+	}
+
 	for _, ev := range evs {
+		if ev.allDay() && allDay.enabled {
+			add(allDay.time(ev, loc), ev, reminderAllDay)
+			continue
+		}
+
 		for _, remT := range t.reminderTimes {
-			remTime := ev.from.Add(-remT)
+			add(ev.from.Add(-remT), ev, reminderStart)
+		}
 
-			if time.Now().Before(remTime) {
-				remPre := reminder{
-					when:  remTime,
-					event: ev,
-				}
+		if ev.allDay() {
+			continue
+		}
 
-				rems = append(rems, remPre)
-			}
+		for _, remT := range endReminderTimes {
+			add(ev.to.Add(-remT), ev, reminderEnd)
 		}
 	}
 
@@ -77,7 +181,9 @@ func (t *reminderTimer) createReminders() ([]reminder, error) {
 	return rems, nil
 }
 
-func reminderLoop(reminders []reminder, stop <-chan struct{}, send func(*calendarEvent)) {
+// reminderLoop sends the reminders at their time. Reminders in the same minute
+// are sent together.
+func reminderLoop(reminders []reminder, stop <-chan struct{}, send func([]reminder)) {
 	for {
 		if len(reminders) == 0 {
 			break
@@ -90,17 +196,210 @@ func reminderLoop(reminders []reminder, stop <-chan struct{}, send func(*calenda
 		select {
 		case <-stop:
 			fmt.Println("Reminderloop stopped")
-			break
+			return
 		case <-time.After(time.Until(next.when)):
-			send(next.event)
-			fmt.Println("Reminder for:", next.event.text, next.event.from.Sub(time.Now()))
+			minute := next.when.Truncate(time.Minute)
+
+			due := []reminder{}
+			for len(reminders) > 0 && reminders[0].when.Truncate(time.Minute).Equal(minute) {
+				due = append(due, reminders[0])
+				fmt.Println("Reminder for:", reminders[0].event.text, reminders[0].event.from.Sub(time.Now()))
 
-			reminders = append([]reminder{}, reminders[1:]...)
+				reminders = append([]reminder{}, reminders[1:]...)
+			}
+
+			send(due)
 		}
 	}
 }
 
-func (t reminderTimer) highestReminderTime() time.Duration {
+// startReminders schedules the reminders of the user, and reschedules them
+// every hour to pick up new events.
+func (u *user) startReminders() {
+	go func() {
+		err := u.initialiseReminderTimer(u.sendReminders, 65*time.Minute)
+		if err != nil {
+			fmt.Println(err)
+		}
+
+		for {
+			<-time.After(60 * time.Minute)
+			fmt.Println("call setup reminder timers")
+			err = u.restartReminderTimer()
+			if err != nil {
+				fmt.Println(err)
+			}
+			fmt.Println("done call setup reminder timers")
+		}
+	}()
+}
+
+// sendReminders sends the reminders to the user, except for events the user
+// acknowledged an earlier reminder for. Reminders at the start of events which
+// were already reminded of are only sent when the user wants repeats.
+func (u *user) sendReminders(rems []reminder) {
+	send := []reminder{}
+
+	for _, rem := range rems {
+		if u.reminders.isAcknowledged(rem.event) {
+			continue
+		}
+
+		atStart := rem.kind == reminderStart && time.Until(rem.event.from) < time.Minute
+		if atStart && !u.repeatsReminders() && u.reminders.isReminded(rem.event) {
+			continue
+		}
+
+		send = append(send, rem)
+	}
+
+	if len(send) == 0 {
+		return
+	}
+
+	u.remind(send)
+}
+
+// sendReminderMessage sends the reminders to the rooms of their calendars, in a
+// single message per room.
+func (u *user) sendReminderMessage(rems []reminder) {
+	rooms := []id.RoomID{}
+	byRoom := make(map[id.RoomID][]reminder)
+
+	for _, rem := range rems {
+		roomID := u.roomFor(rem.event)
+		if _, ok := byRoom[roomID]; !ok {
+			rooms = append(rooms, roomID)
+		}
+		byRoom[roomID] = append(byRoom[roomID], rem)
+	}
+
+	for _, roomID := range rooms {
+		u.sendReminderMessageTo(roomID, byRoom[roomID])
+	}
+}
+
+// sendReminderMessageTo sends a single message for the reminders, and tracks
+// it so it can be snoozed and acknowledged. A message sent earlier for the same
+// events is edited instead, like the reminder 30 minutes before an event into
+// "starts now". Users who want unacknowledged reminders repeated get a new
+// message, as edits don't notify.
+func (u *user) sendReminderMessageTo(roomID id.RoomID, rems []reminder) {
+	reply := formatReminders(rems, u.reminderTemplate(), time.Now(), u.location())
+	sender := u.messageSender()
+
+	evID, edit := u.reminders.previousMessage(rems)
+	if u.repeatsReminders() {
+		edit = false
+	}
+	if edit {
+		_, err := sender.editMessage(roomID, evID, reply.msg, reply.msgF).wait()
+		if err != nil {
+			fmt.Println("edit reminder:", u.userID, err)
+			edit = false
+		}
+	}
+
+	if !edit {
+		var err error
+		evID, err = sender.sendMessage(roomID, reply.msg, reply.msgF, true).wait()
+		if err != nil {
+			fmt.Println("reminder:", u.userID, err)
+		}
+	}
+
+	u.reminders.track(evID, rems)
+	if evID != "" {
+		u.reminders.afterEnd(evID, rems, u.reminderEnded)
+	}
+}
+
+// reminderEndedAction is what happens to a reminder message once its events ended.
+type reminderEndedAction string
+
+const (
+	reminderEndedKeep   = reminderEndedAction("")
+	reminderEndedEdit   = reminderEndedAction("edit")
+	reminderEndedRedact = reminderEndedAction("redact")
+)
+
+// reminderEnded edits or redacts the reminder message evID, depending on the
+// settings of the user.
+func (u *user) reminderEnded(evID id.EventID, rems []reminder) {
+	var err error
+	roomID := u.roomFor(rems[0].event)
+
+	switch u.reminderEndedAction() {
+	case reminderEndedEdit:
+		text, textF := formatEventNames(rems)
+		_, err = u.messageSender().editMessage(roomID, evID, "Ended: "+text, "Ended: "+textF).wait()
+	case reminderEndedRedact:
+		_, err = u.messageSender().redactMessage(roomID, evID).wait()
+	}
+
+	if err != nil {
+		fmt.Println("ended reminder:", u.userID, err)
+	}
+}
+
+func formatReminders(rems []reminder, tmpl reminderTemplate, now time.Time, loc *time.Location) cmdReply {
+	format := func(rem reminder) (string, string) {
+		text, textF, err := tmpl.format(rem, now, loc)
+		if err != nil {
+			fmt.Println("reminder template:", err)
+			text, textF, _ = reminderTemplate{}.format(rem, now, loc)
+		}
+		return text, textF
+	}
+
+	if len(rems) == 1 {
+		text, textF := format(rems[0])
+		return cmdReply{"Reminder: " + text, "Reminder: " + textF}
+	}
+
+	lines := []string{"Reminders:"}
+	linesF := []string{"<b>Reminders:</b>"}
+
+	for _, rem := range rems {
+		text, textF := format(rem)
+		lines = append(lines, "* "+text)
+		linesF = append(linesF, "&nbsp;&#9702; "+textF)
+	}
+
+	return cmdReply{strings.Join(lines, "\n"), strings.Join(linesF, "<br />\n")}
+}
+
+// describe tells what the reminder is about, like "starts in 5 minutes".
+func (r reminder) describe(now time.Time) string {
+	ev := r.event
+
+	switch r.kind {
+	case reminderEnd:
+		timeUntil := ev.to.Sub(now)
+		if timeUntil.Minutes() >= 1 {
+			return fmt.Sprintf("ends in %d minutes", int(timeUntil.Minutes()))
+		}
+		return "ends now"
+	case reminderAllDay:
+		loc := ev.from.Location()
+		today := timeStartOfToday(now.In(loc), loc)
+		switch {
+		case ev.from.Before(today.AddDate(0, 0, 1)):
+			return "is today"
+		case ev.from.Before(today.AddDate(0, 0, 2)):
+			return "is tomorrow"
+		}
+		return "is on " + ev.from.Format("Monday 2 January")
+	}
+
+	timeUntil := ev.from.Sub(now)
+	if timeUntil.Minutes() > 0 {
+		return fmt.Sprintf("starts in %d minutes", int(timeUntil.Minutes()))
+	}
+	return "starts now"
+}
+
+func (t *reminderTimer) highestReminderTime() time.Duration {
 	highest := 0 * time.Second
 	for _, remT := range t.reminderTimes {
 		if remT > highest {
@@ -111,10 +410,46 @@ func (t reminderTimer) highestReminderTime() time.Duration {
 	return highest
 }
 
+// parseMinutesList parses a comma separated list of minutes, like "10,0".
+func parseMinutesList(str string) ([]time.Duration, error) {
+	durations := []time.Duration{}
+	for _, part := range strings.Split(str, ",") {
+		minutes, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return durations, err
+		}
+		if minutes < 0 {
+			return durations, fmt.Errorf("negative amount of minutes: %d", minutes)
+		}
+
+		durations = append(durations, time.Duration(minutes)*time.Minute)
+	}
+
+	return durations, nil
+}
+
+func formatMinutesList(durations []time.Duration) string {
+	parts := []string{}
+	for _, d := range durations {
+		parts = append(parts, strconv.Itoa(int(d.Minutes())))
+	}
+
+	return strings.Join(parts, ",")
+}
+
+type reminderKind int
+
+const (
+	reminderStart reminderKind = iota
+	reminderEnd
+	reminderAllDay
+)
+
 type reminder struct {
 	when time.Time
 
 	event *calendarEvent
+	kind  reminderKind
 }
 
 type reminders []reminder
@@ -77,15 +77,78 @@ func TestCreateRemindersCreatesTheCorrectReminders(t *testing.T) {
 	assertEqual(t, reminders[3].when, ev4.from, "reminder has correct when")
 }
 
+func TestCreateRemindersForEndAndAllDayEvents(t *testing.T) {
+	tomorrow := timeStartOfToday(time.Now(), time.Local).AddDate(0, 0, 1)
+
+	ev0 := &calendarEvent{
+		from: time.Now().Add(-time.Hour),
+		to:   time.Now().Add(20 * time.Minute),
+		text: "test event in progress",
+	}
+	ev1 := &calendarEvent{
+		from: tomorrow,
+		to:   tomorrow.AddDate(0, 0, 1),
+		text: "test all-day event",
+	}
+
+	timer := newReminderTimer(nil, 48*time.Hour, newMockCalendar([]*calendarEvent{ev0, ev1}), []time.Duration{0})
+
+	allDay := allDayReminder{enabled: true, at: timeOfDay{8, 0}}
+	timer.configure([]time.Duration{10 * time.Minute}, allDay, time.Local)
+
+	reminders, err := timer.createReminders()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(reminders) != 2 {
+		t.Fatalf("received incorrect amount of reminders, got: %d", len(reminders))
+	}
+
+	assertEqual(t, reminders[0].event, ev0, "reminder has correct event")
+	assertEqual(t, reminders[0].kind, reminderEnd, "reminder is for the end of the event")
+	assertEqual(t, reminders[0].when, ev0.to.Add(-10*time.Minute), "reminder has correct when")
+
+	assertEqual(t, reminders[1].event, ev1, "reminder has correct event")
+	assertEqual(t, reminders[1].kind, reminderAllDay, "reminder is for an all-day event")
+	assertEqual(t, reminders[1].when, tomorrow.Add(8*time.Hour), "reminder has correct when")
+}
+
+func TestReminderTimerUpcoming(t *testing.T) {
+	ev := &calendarEvent{
+		from: time.Now().Add(15 * time.Minute),
+		to:   time.Now().Add(75 * time.Minute),
+		text: "test event",
+	}
+
+	timer := newReminderTimer(func([]reminder) {}, 30*time.Minute, newMockCalendar([]*calendarEvent{ev}), []time.Duration{0, 10 * time.Minute, 30 * time.Minute})
+	err := timer.set()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { timer.stopTimer <- struct{}{} }()
+
+	upcoming := timer.upcoming()
+	if len(upcoming) != 2 {
+		t.Fatalf("received incorrect amount of upcoming reminders, got: %d", len(upcoming))
+	}
+
+	assertEqual(t, upcoming[0].when, ev.from.Add(-10*time.Minute), "upcoming reminder has correct when")
+	assertEqual(t, upcoming[1].when, ev.from, "upcoming reminder has correct when")
+}
+
 func TestReminderLoopSendsTheCorrectReminders(t *testing.T) {
+	minute := time.Now().Truncate(time.Minute)
+
 	ev0 := &calendarEvent{
 		from: time.Now(),
 		to:   time.Now().Add(75 * time.Minute),
 		text: "test event 0",
 	}
 	r0 := reminder{
-		time.Now(),
+		minute.Add(-2 * time.Minute),
 		ev0,
+		reminderStart,
 	}
 
 	ev1 := &calendarEvent{
@@ -94,8 +157,9 @@ func TestReminderLoopSendsTheCorrectReminders(t *testing.T) {
 		text: "test event 1",
 	}
 	r1 := reminder{
-		time.Now(),
+		minute,
 		ev1,
+		reminderStart,
 	}
 	ev2 := &calendarEvent{
 		from: time.Now(),
@@ -103,27 +167,47 @@ func TestReminderLoopSendsTheCorrectReminders(t *testing.T) {
 		text: "test event 2",
 	}
 	r2 := reminder{
-		time.Now(),
+		minute.Add(30 * time.Second),
 		ev2,
+		reminderStart,
 	}
 
 	reminders := []reminder{r0, r1, r2}
 
-	received := []*calendarEvent{}
+	received := [][]reminder{}
 
-	reminderCallback := func(ev *calendarEvent) {
-		received = append(received, ev)
+	reminderCallback := func(rems []reminder) {
+		received = append(received, rems)
 	}
 
 	reminderLoop(reminders, nil, reminderCallback)
 
-	if len(received) != 3 {
-		t.Errorf("received incorrect amount of reminders, got: %d", len(received))
+	if len(received) != 2 {
+		t.Fatalf("received incorrect amount of reminder messages, got: %d", len(received))
+	}
+	if len(received[1]) != 2 {
+		t.Fatalf("reminders in the same minute are not merged, got: %d", len(received[1]))
 	}
 
-	assertEqual(t, received[0], ev0, "reminder has correct event")
-	assertEqual(t, received[1], ev1, "reminder has correct event")
-	assertEqual(t, received[2], ev2, "reminder has correct event")
+	assertEqual(t, received[0][0].event, ev0, "reminder has correct event")
+	assertEqual(t, received[1][0].event, ev1, "reminder has correct event")
+	assertEqual(t, received[1][1].event, ev2, "reminder has correct event")
+}
+
+func TestFormatRemindersMergesEvents(t *testing.T) {
+	now := time.Date(2020, 11, 9, 10, 0, 0, 0, time.Local)
+
+	rems := []reminder{
+		{now, &calendarEvent{from: now, to: now.Add(time.Hour), text: "standup"}, reminderStart},
+		{now, &calendarEvent{from: now.Add(30 * time.Minute), to: now.Add(time.Hour), text: "review"}, reminderStart},
+		{now, &calendarEvent{from: now.Add(-time.Hour), to: now.Add(10 * time.Minute), text: "workshop"}, reminderEnd},
+	}
+
+	single := formatReminders(rems[:1], reminderTemplate{}, now, time.Local)
+	assertEqual(t, single.msg, `Reminder: "standup" starts now`, "single reminder is formatted")
+
+	merged := formatReminders(rems, reminderTemplate{}, now, time.Local)
+	assertEqual(t, merged.msg, "Reminders:\n* \"standup\" starts now\n* \"review\" starts in 30 minutes\n* \"workshop\" ends in 10 minutes", "merged reminders are formatted")
 }
 
 func assertEqual(t *testing.T, a interface{}, b interface{}, message string) {
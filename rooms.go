@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// directRooms gives the direct chats of the user with the bot, starting with
+// the one reminders are sent to.
+func (u *user) directRooms() []id.RoomID {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+
+	rooms := []id.RoomID{}
+	if u.roomID != "" {
+		rooms = append(rooms, u.roomID)
+	}
+	return append(rooms, u.otherRooms...)
+}
+
+// hasRoom reports whether the room is one of the direct chats of the user.
+func (u *user) hasRoom(roomID id.RoomID) bool {
+	for _, r := range u.directRooms() {
+		if r == roomID {
+			return true
+		}
+	}
+	return false
+}
+
+// addRoom registers the room as another direct chat of the user, returning
+// whether it wasn't known yet.
+func (u *user) addRoom(roomID id.RoomID) (bool, error) {
+	if u.hasRoom(roomID) {
+		return false, nil
+	}
+
+	u.mutex.RLock()
+	userID := u.userID
+	u.mutex.RUnlock()
+
+	err := u.persist.addUserRoom(userID, roomID)
+	if err != nil {
+		return false, err
+	}
+
+	u.mutex.Lock()
+	u.otherRooms = append(u.otherRooms, roomID)
+	u.mutex.Unlock()
+
+	return true, nil
+}
+
+// useRoom makes the room the one reminders and other messages are sent to.
+// The room used before is kept as another room of the user.
+func (u *user) useRoom(roomID id.RoomID) error {
+	u.mutex.RLock()
+	userID := u.userID
+	previous := u.roomID
+	u.mutex.RUnlock()
+
+	if previous == roomID {
+		return nil
+	}
+
+	err := u.storeRoomID(roomID)
+	if err != nil {
+		return err
+	}
+
+	err = u.persist.removeUserRoom(userID, roomID)
+	if err != nil {
+		return err
+	}
+	if previous != "" {
+		err = u.persist.addUserRoom(userID, previous)
+		if err != nil {
+			return err
+		}
+	}
+
+	u.mutex.Lock()
+	u.otherRooms = withoutRoom(u.otherRooms, roomID)
+	if previous != "" {
+		u.otherRooms = append(u.otherRooms, previous)
+	}
+	u.mutex.Unlock()
+
+	return nil
+}
+
+// leaveRoom forgets the room of the user, who must have another room. When
+// reminders were sent to the room, they are sent to the oldest other room
+// from now on.
+func (u *user) leaveRoom(roomID id.RoomID) error {
+	u.mutex.RLock()
+	userID := u.userID
+	current := u.roomID
+	otherRooms := u.otherRooms
+	u.mutex.RUnlock()
+
+	if len(otherRooms) == 0 {
+		return fmt.Errorf("user %s has no other room to use instead of %s", userID, roomID)
+	}
+
+	if current == roomID {
+		next := otherRooms[0]
+		err := u.useRoom(next)
+		if err != nil {
+			return err
+		}
+
+		u.messageSender().sendNotice(next,
+			"You left the room I used to send your reminders to, so I'll send them here from now on.", "").logFailure("notice")
+	}
+
+	err := u.persist.removeUserRoom(userID, roomID)
+	if err != nil {
+		return err
+	}
+
+	u.mutex.Lock()
+	u.otherRooms = withoutRoom(u.otherRooms, roomID)
+	u.mutex.Unlock()
+
+	return nil
+}
+
+func withoutRoom(rooms []id.RoomID, roomID id.RoomID) []id.RoomID {
+	kept := []id.RoomID{}
+	for _, r := range rooms {
+		if r != roomID {
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
+
+// formatOtherRoom tells the user reminders are sent to another room.
+func formatOtherRoom(roomID id.RoomID) cmdReply {
+	return cmdReply{
+		"Your reminders are sent to another room: " + string(roomID) + ". Say 'use this room' to receive them here instead.",
+		"Your reminders are sent to another room: <code>" + string(roomID) + "</code>. Say <code>use this room</code> to receive them here instead."}
+}
+
+func cmdUseRoom(u *user, roomID id.RoomID, args []string) (cmdReply, error) {
+	if strings.Join(args, " ") != "use this room" {
+		return formatUsage(usageUseRoom), nil
+	}
+
+	if u.RoomID() == roomID {
+		return cmdReply{"Your reminders are already sent to this room", ""}, nil
+	}
+	if !u.hasRoom(roomID) {
+		return cmdReply{"Sorry, I can only send your reminders to a direct chat with you", ""}, nil
+	}
+
+	err := u.useRoom(roomID)
+	if err != nil {
+		return cmdReply{}, err
+	}
+
+	return cmdReply{"Your reminders, digests and weekly overviews will be sent to this room from now on", ""}, nil
+}
+
+func cmdRooms(u *user, roomID id.RoomID) cmdReply {
+	lines := []string{"Your rooms:"}
+	linesF := []string{"<b>Your rooms:</b>"}
+
+	for i, r := range u.directRooms() {
+		line := string(r)
+		lineF := "<code>" + string(r) + "</code>"
+
+		notes := []string{}
+		if i == 0 {
+			notes = append(notes, "receives reminders")
+		}
+		if r == roomID {
+			notes = append(notes, "this room")
+		}
+		if len(notes) > 0 {
+			line += " (" + strings.Join(notes, ", ") + ")"
+			lineF += " (" + strings.Join(notes, ", ") + ")"
+		}
+
+		lines = append(lines, "* "+line)
+		linesF = append(linesF, "&nbsp;&#9702; "+lineF)
+	}
+
+	return cmdReply{strings.Join(lines, "\n"), strings.Join(linesF, "<br />\n")}
+}
+
+var usageUseRoom = helpCommand{
+	"use this room",
+	"Send your reminders, digests and weekly overviews to this room instead of your other room",
+	"use this room",
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"maunium.net/go/mautrix/id"
+)
+
+func TestUserRooms(t *testing.T) {
+	u := &user{
+		roomID:     "!primary:example.org",
+		otherRooms: []id.RoomID{"!phone:example.org"},
+		calendars: []*userCalendar{
+			{Name: "work", RoomID: "!team:example.org"},
+			{Name: "home", RoomID: "!phone:example.org"},
+			{Name: "personal"},
+		},
+	}
+
+	assertEqual(t, len(u.directRooms()), 2, "direct rooms include the other rooms")
+	assertEqual(t, u.directRooms()[0], id.RoomID("!primary:example.org"), "room receiving reminders comes first")
+	assertEqual(t, u.hasRoom("!phone:example.org"), true, "other room is a room of the user")
+	assertEqual(t, u.hasRoom("!team:example.org"), false, "calendar room isn't a direct room of the user")
+	assertEqual(t, len(u.rooms()), 3, "rooms include calendar rooms once")
+
+	rooms := withoutRoom([]id.RoomID{"!a:example.org", "!b:example.org"}, "!a:example.org")
+	assertEqual(t, len(rooms), 1, "room is removed")
+	assertEqual(t, rooms[0], id.RoomID("!b:example.org"), "other rooms are kept")
+
+	only := &user{roomID: "!primary:example.org"}
+	assertEqual(t, only.leaveRoom("!primary:example.org") != nil, true, "only room of the user can't be left")
+}
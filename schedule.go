@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// timeOfDay is a wall clock time, independent of date and location.
+type timeOfDay struct {
+	hour, minute int
+}
+
+var errInvalidTimeOfDay = errors.New("invalid time of day")
+
+// parseTimeOfDay parses times formatted as 15:04 (or 7:30).
+func parseTimeOfDay(str string) (timeOfDay, error) {
+	parts := strings.Split(str, ":")
+	if len(parts) != 2 {
+		return timeOfDay{}, errInvalidTimeOfDay
+	}
+
+	hour, err := strconv.Atoi(parts[0])
+	if err != nil || hour < 0 || hour > 23 {
+		return timeOfDay{}, errInvalidTimeOfDay
+	}
+
+	minute, err := strconv.Atoi(parts[1])
+	if err != nil || minute < 0 || minute > 59 || len(parts[1]) != 2 {
+		return timeOfDay{}, errInvalidTimeOfDay
+	}
+
+	return timeOfDay{hour, minute}, nil
+}
+
+func (t timeOfDay) String() string {
+	return fmt.Sprintf("%02d:%02d", t.hour, t.minute)
+}
+
+// on gives the time at this time of day on the date of the given time, in loc.
+func (t timeOfDay) on(date time.Time, loc *time.Location) time.Time {
+	date = date.In(loc)
+	return time.Date(date.Year(), date.Month(), date.Day(), t.hour, t.minute, 0, 0, loc)
+}
+
+// nextDaily gives the first moment after the given time at which the clock in
+// loc shows the time of day.
+func (t timeOfDay) nextDaily(after time.Time, loc *time.Location) time.Time {
+	next := t.on(after, loc)
+	for !next.After(after) {
+		next = t.on(next.AddDate(0, 0, 1), loc)
+	}
+
+	return next
+}
+
+// nextWeekly gives the first moment after the given time at which it is the
+// weekday and the clock in loc shows the time of day.
+func (t timeOfDay) nextWeekly(after time.Time, weekday time.Weekday, loc *time.Location) time.Time {
+	next := t.nextDaily(after, loc)
+	for next.Weekday() != weekday {
+		next = t.nextDaily(next, loc)
+	}
+
+	return next
+}
+
+// recurringTimer calls fn each time the moment given by next arrives,
+// until it is stopped.
+type recurringTimer struct {
+	next func(after time.Time) time.Time
+	fn   func()
+
+	mutex   sync.Mutex
+	timer   *time.Timer
+	stopped bool
+}
+
+func newRecurringTimer(next func(after time.Time) time.Time, fn func()) *recurringTimer {
+	return &recurringTimer{next: next, fn: fn}
+}
+
+// start schedules the first call of fn.
+func (t *recurringTimer) start() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.stopped = false
+	t.schedule(time.Now())
+}
+
+// schedule sets the timer for the first moment after the given time.
+// The mutex must be held by the caller.
+func (t *recurringTimer) schedule(after time.Time) {
+	when := t.next(after)
+
+	t.timer = time.AfterFunc(time.Until(when), func() {
+		t.mutex.Lock()
+		if t.stopped {
+			t.mutex.Unlock()
+			return
+		}
+		t.schedule(when)
+		t.mutex.Unlock()
+
+		t.fn()
+	})
+}
+
+// stop prevents any further calls of fn.
+func (t *recurringTimer) stop() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.stopped = true
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTimeOfDay(t *testing.T) {
+	var tests = []struct {
+		str string
+
+		expect    timeOfDay
+		expectErr bool
+	}{
+		{"07:30", timeOfDay{7, 30}, false},
+		{"7:30", timeOfDay{7, 30}, false},
+		{"23:59", timeOfDay{23, 59}, false},
+		{"00:00", timeOfDay{0, 0}, false},
+		{"24:00", timeOfDay{}, true},
+		{"12:60", timeOfDay{}, true},
+		{"12:5", timeOfDay{}, true},
+		{"1230", timeOfDay{}, true},
+		{"noon", timeOfDay{}, true},
+	}
+
+	for _, test := range tests {
+		got, err := parseTimeOfDay(test.str)
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("expected error for %q", test.str)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %q: %s", test.str, err)
+		}
+		if got != test.expect {
+			t.Errorf("parsing %q, expected: %s, got: %s", test.str, test.expect, got)
+		}
+	}
+}
+
+func TestTimeOfDayNextDaily(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Amsterdam")
+	if err != nil {
+		t.Error(err)
+	}
+
+	at := timeOfDay{7, 30}
+
+	var tests = []struct {
+		after  time.Time
+		expect time.Time
+	}{
+		{
+			time.Date(2020, 11, 9, 6, 0, 0, 0, loc),
+			time.Date(2020, 11, 9, 7, 30, 0, 0, loc),
+		},
+		{
+			time.Date(2020, 11, 9, 7, 30, 0, 0, loc),
+			time.Date(2020, 11, 10, 7, 30, 0, 0, loc),
+		},
+		{
+			time.Date(2020, 11, 9, 23, 0, 0, 0, loc),
+			time.Date(2020, 11, 10, 7, 30, 0, 0, loc),
+		},
+		{
+			// 23:00 UTC is already the next day in Amsterdam.
+			time.Date(2020, 11, 9, 23, 0, 0, 0, time.UTC),
+			time.Date(2020, 11, 10, 7, 30, 0, 0, loc),
+		},
+		{
+			// Daylight saving time ends on 25 October.
+			time.Date(2020, 10, 24, 8, 0, 0, 0, loc),
+			time.Date(2020, 10, 25, 7, 30, 0, 0, loc),
+		},
+	}
+
+	for _, test := range tests {
+		assertTimeEquals(t, test.expect, at.nextDaily(test.after, loc))
+	}
+}
+
+func TestTimeOfDayNextWeekly(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Amsterdam")
+	if err != nil {
+		t.Error(err)
+	}
+
+	at := timeOfDay{19, 0}
+
+	var tests = []struct {
+		after   time.Time
+		weekday time.Weekday
+		expect  time.Time
+	}{
+		{
+			time.Date(2020, 11, 9, 6, 0, 0, 0, loc),
+			time.Sunday,
+			time.Date(2020, 11, 15, 19, 0, 0, 0, loc),
+		},
+		{
+			time.Date(2020, 11, 15, 18, 0, 0, 0, loc),
+			time.Sunday,
+			time.Date(2020, 11, 15, 19, 0, 0, 0, loc),
+		},
+		{
+			time.Date(2020, 11, 15, 19, 0, 0, 0, loc),
+			time.Sunday,
+			time.Date(2020, 11, 22, 19, 0, 0, 0, loc),
+		},
+		{
+			time.Date(2020, 11, 15, 20, 0, 0, 0, loc),
+			time.Friday,
+			time.Date(2020, 11, 20, 19, 0, 0, 0, loc),
+		},
+	}
+
+	for _, test := range tests {
+		assertTimeEquals(t, test.expect, at.nextWeekly(test.after, test.weekday, loc))
+	}
+}
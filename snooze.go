@@ -0,0 +1,378 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	reactionSnooze      = "💤"
+	reactionAcknowledge = "✅"
+
+	defaultSnooze = 5 * time.Minute
+)
+
+// reminderTracker keeps track of the reminder messages sent to a user, so the
+// user can snooze and acknowledge them.
+type reminderTracker struct {
+	mutex sync.Mutex
+
+	// sent maps the Matrix event IDs of sent reminder messages to their reminders.
+	sent map[id.EventID][]reminder
+	// reminded contains the keys of the events a reminder has been sent for.
+	reminded map[string]*calendarEvent
+	// acknowledged contains the keys of the events the user acknowledged.
+	acknowledged map[string]*calendarEvent
+	snoozed      map[string]*time.Timer
+
+	// messages maps the keys of events to the last reminder message sent for them.
+	messages map[string]id.EventID
+	// ended has the timers which update the reminder messages after their events ended.
+	ended map[id.EventID]*time.Timer
+}
+
+// track records that the reminders have been sent as the Matrix event evID.
+func (t *reminderTracker) track(evID id.EventID, rems []reminder) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.sent == nil {
+		t.sent = make(map[id.EventID][]reminder)
+		t.reminded = make(map[string]*calendarEvent)
+		t.messages = make(map[string]id.EventID)
+	}
+
+	t.clean()
+
+	if evID != "" {
+		t.sent[evID] = rems
+	}
+	for _, rem := range rems {
+		t.reminded[rem.event.key()] = rem.event
+		if evID != "" {
+			t.messages[rem.event.key()] = evID
+		}
+	}
+}
+
+// previousMessage gives the reminder message sent earlier for exactly the
+// events of the reminders, which can be edited instead of sending a new one.
+func (t *reminderTracker) previousMessage(rems []reminder) (id.EventID, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if len(rems) == 0 {
+		return "", false
+	}
+
+	evID, ok := t.messages[rems[0].event.key()]
+	if !ok || len(t.sent[evID]) != len(rems) {
+		return "", false
+	}
+
+	for _, rem := range rems {
+		if t.messages[rem.event.key()] != evID {
+			return "", false
+		}
+	}
+
+	return evID, true
+}
+
+// afterEnd calls ended with the reminders of the message evID once all of
+// their events ended, replacing an earlier call for the message.
+func (t *reminderTracker) afterEnd(evID id.EventID, rems []reminder, ended func(id.EventID, []reminder)) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.ended == nil {
+		t.ended = make(map[id.EventID]*time.Timer)
+	}
+	if earlier, ok := t.ended[evID]; ok {
+		earlier.Stop()
+	}
+
+	end := time.Time{}
+	for _, rem := range rems {
+		if rem.event.to.After(end) {
+			end = rem.event.to
+		}
+	}
+
+	t.ended[evID] = time.AfterFunc(time.Until(end), func() {
+		t.mutex.Lock()
+		delete(t.ended, evID)
+		t.mutex.Unlock()
+
+		ended(evID, rems)
+	})
+}
+
+// clean forgets about events which ended over an hour ago.
+// The mutex must be held by the caller.
+func (t *reminderTracker) clean() {
+	old := func(ev *calendarEvent) bool {
+		return ev.to.Before(time.Now().Add(-time.Hour))
+	}
+
+	for evID, rems := range t.sent {
+		if old(rems[len(rems)-1].event) {
+			delete(t.sent, evID)
+		}
+	}
+	for key, ev := range t.reminded {
+		if old(ev) {
+			delete(t.reminded, key)
+		}
+	}
+	for key, ev := range t.acknowledged {
+		if old(ev) {
+			delete(t.acknowledged, key)
+		}
+	}
+	for key, evID := range t.messages {
+		if _, ok := t.sent[evID]; !ok {
+			delete(t.messages, key)
+		}
+	}
+}
+
+// sentReminders gives the reminders sent as the Matrix event with the given ID.
+func (t *reminderTracker) sentReminders(evID id.EventID) ([]reminder, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	rems, ok := t.sent[evID]
+	return rems, ok
+}
+
+func (t *reminderTracker) isReminded(ev *calendarEvent) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	_, ok := t.reminded[ev.key()]
+	return ok
+}
+
+func (t *reminderTracker) isAcknowledged(ev *calendarEvent) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	_, ok := t.acknowledged[ev.key()]
+	return ok
+}
+
+// acknowledge marks the events of the reminders as acknowledged, so snoozed
+// reminders for them aren't sent.
+func (t *reminderTracker) acknowledge(rems []reminder) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.acknowledged == nil {
+		t.acknowledged = make(map[string]*calendarEvent)
+	}
+	for _, rem := range rems {
+		t.acknowledged[rem.event.key()] = rem.event
+	}
+}
+
+// snooze calls remind with the reminders for events not acknowledged in the
+// meantime after the given duration, replacing any earlier snooze of the events.
+func (t *reminderTracker) snooze(rems []reminder, d time.Duration, remind func([]reminder)) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.snoozed == nil {
+		t.snoozed = make(map[string]*time.Timer)
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(d, func() {
+		t.mutex.Lock()
+		remaining := []reminder{}
+		for _, rem := range rems {
+			key := rem.event.key()
+			if t.snoozed[key] == timer {
+				delete(t.snoozed, key)
+			}
+			if _, ok := t.acknowledged[key]; !ok {
+				remaining = append(remaining, rem)
+			}
+		}
+		t.mutex.Unlock()
+
+		if len(remaining) > 0 {
+			remind(remaining)
+		}
+	})
+
+	for _, rem := range rems {
+		key := rem.event.key()
+		if earlier, ok := t.snoozed[key]; ok {
+			earlier.Stop()
+		}
+		t.snoozed[key] = timer
+
+		// Snoozed reminders are sent as a new message, so the user is notified.
+		delete(t.messages, key)
+	}
+}
+
+// handleReminderReaction handles reactions to reminders, returning whether
+// the reaction was meant for a reminder.
+func handleReminderReaction(data *store, ev *event.Event) (cmdReply, bool) {
+	content := ev.Content.AsReaction()
+
+	u, rems, ok := sentReminders(data, ev, content.RelatesTo.EventID)
+	if !ok {
+		return cmdReply{}, false
+	}
+
+	switch strings.TrimSuffix(content.RelatesTo.Key, "\ufe0f") {
+	case reactionSnooze:
+		return u.snoozeReminder(rems, defaultSnooze), true
+	case reactionAcknowledge:
+		return u.acknowledgeReminder(rems), true
+	}
+
+	return cmdReply{}, false
+}
+
+// handleReminderReply handles replies to reminders like "snooze 10m" and "ok",
+// returning whether the message was a reply to a reminder.
+func handleReminderReply(data *store, ev *event.Event) (cmdReply, bool) {
+	content := ev.Content.AsMessage()
+
+	replyTo := content.GetReplyTo()
+	if replyTo == "" {
+		return cmdReply{}, false
+	}
+
+	u, rems, ok := sentReminders(data, ev, replyTo)
+	if !ok {
+		return cmdReply{}, false
+	}
+
+	content.RemoveReplyFallback()
+	args := strings.Fields(strings.ToLower(content.Body))
+	if len(args) == 0 {
+		return formatUsage(usageSnooze), true
+	}
+
+	switch args[0] {
+	case "snooze":
+		d := defaultSnooze
+		if len(args) >= 2 {
+			var err error
+			d, err = parseSnoozeDuration(strings.Join(args[1:], ""))
+			if err != nil {
+				return formatUsage(usageSnooze), true
+			}
+		}
+		return u.snoozeReminder(rems, d), true
+	case "ok", "okay", "done", "dismiss", "ack", "thanks":
+		return u.acknowledgeReminder(rems), true
+	}
+
+	return formatUsage(usageSnooze), true
+}
+
+// sentReminders gives the reminders sent as the Matrix event evID, to the
+// sender of ev or to the group room ev is sent in.
+func sentReminders(data *store, ev *event.Event, evID id.EventID) (*user, []reminder, bool) {
+	if r := data.groupRoom(ev.RoomID); r != nil {
+		rems, ok := r.reminders.sentReminders(evID)
+		return r, rems, ok
+	}
+
+	u, err := data.user(ev.Sender)
+	if err != nil {
+		fmt.Println(err)
+		return nil, nil, false
+	}
+
+	rems, ok := u.reminders.sentReminders(evID)
+	return u, rems, ok
+}
+
+// parseSnoozeDuration parses durations like 10m, 1h and 10min.
+// Numbers without a unit are taken as minutes.
+func parseSnoozeDuration(str string) (time.Duration, error) {
+	var d time.Duration
+	if minutes, err := strconv.Atoi(str); err == nil {
+		d = time.Duration(minutes) * time.Minute
+	} else {
+		str = strings.TrimSuffix(str, "ins")
+		str = strings.TrimSuffix(str, "in")
+		d, err = time.ParseDuration(str)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if d <= 0 {
+		return 0, fmt.Errorf("snooze duration should be positive")
+	}
+
+	return d, nil
+}
+
+func (u *user) snoozeReminder(rems []reminder, d time.Duration) cmdReply {
+	u.reminders.snooze(rems, d, u.remind)
+
+	text, textF := formatEventNames(rems)
+	return cmdReply{
+		fmt.Sprintf("Snoozed %s for %s", text, formatSnoozeDuration(d)),
+		fmt.Sprintf("Snoozed %s for %s", textF, formatSnoozeDuration(d))}
+}
+
+func (u *user) acknowledgeReminder(rems []reminder) cmdReply {
+	u.reminders.acknowledge(rems)
+
+	text, textF := formatEventNames(rems)
+	return cmdReply{
+		fmt.Sprintf("Got it, no more reminders for %s", text),
+		fmt.Sprintf("Got it, no more reminders for %s", textF)}
+}
+
+// formatEventNames lists the names of the events of the reminders, like: "a", "b" and "c".
+func formatEventNames(rems []reminder) (text string, textF string) {
+	names := []string{}
+	namesF := []string{}
+	for _, rem := range rems {
+		names = append(names, fmt.Sprintf("%q", rem.event.text))
+		namesF = append(namesF, "<b>"+html.EscapeString(rem.event.text)+"</b>")
+	}
+
+	join := func(names []string) string {
+		if len(names) == 1 {
+			return names[0]
+		}
+		return strings.Join(names[:len(names)-1], ", ") + " and " + names[len(names)-1]
+	}
+
+	return join(names), join(namesF)
+}
+
+func formatSnoozeDuration(d time.Duration) string {
+	if d < time.Hour || d%time.Hour != 0 {
+		return strconv.Itoa(int(d.Minutes())) + " minutes"
+	}
+	if d == time.Hour {
+		return "1 hour"
+	}
+	return strconv.Itoa(int(d.Hours())) + " hours"
+}
+
+var usageSnooze = helpCommand{
+	"snooze [{duration}]",
+	"Reply to a reminder to be reminded again after the duration (5 minutes by default), or reply 'ok' to stop further reminders. Reacting with " + reactionSnooze + " or " + reactionAcknowledge + " works too",
+	"snooze 10m",
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+func TestParseSnoozeDuration(t *testing.T) {
+	var tests = []struct {
+		str string
+
+		expect    time.Duration
+		expectErr bool
+	}{
+		{"10", 10 * time.Minute, false},
+		{"10m", 10 * time.Minute, false},
+		{"10min", 10 * time.Minute, false},
+		{"10mins", 10 * time.Minute, false},
+		{"1h", time.Hour, false},
+		{"1h30m", 90 * time.Minute, false},
+		{"0", 0, true},
+		{"-5m", 0, true},
+		{"later", 0, true},
+	}
+
+	for _, test := range tests {
+		got, err := parseSnoozeDuration(test.str)
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("expected error for %q", test.str)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %q: %s", test.str, err)
+		}
+		assertEqual(t, got, test.expect, "snooze duration is parsed")
+	}
+}
+
+func TestReminderTrackerAcknowledgeCancelsSnooze(t *testing.T) {
+	ev := &calendarEvent{
+		from: time.Now().Add(15 * time.Minute),
+		to:   time.Now().Add(75 * time.Minute),
+		text: "test event",
+	}
+
+	tracker := reminderTracker{}
+	tracker.track("$reminder", []reminder{{when: time.Now(), event: ev}})
+
+	got, ok := tracker.sentReminders("$reminder")
+	if !ok {
+		t.Fatal("sent reminder is not tracked")
+	}
+	assertEqual(t, got[0].event, ev, "tracked reminder has correct event")
+
+	reminded := false
+	tracker.snooze(got, 10*time.Millisecond, func([]reminder) {
+		reminded = true
+	})
+	tracker.acknowledge(got)
+
+	<-time.After(50 * time.Millisecond)
+
+	if reminded {
+		t.Error("snoozed reminder was sent after acknowledging")
+	}
+	if !tracker.isAcknowledged(ev) {
+		t.Error("event is not acknowledged")
+	}
+}
+
+func TestReminderTrackerPreviousMessage(t *testing.T) {
+	ev0 := &calendarEvent{from: time.Now().Add(30 * time.Minute), to: time.Now().Add(time.Hour), text: "test event 0"}
+	ev1 := &calendarEvent{from: time.Now().Add(30 * time.Minute), to: time.Now().Add(time.Hour), text: "test event 1"}
+
+	tracker := reminderTracker{}
+	tracker.track("$both", []reminder{{time.Now(), ev0, reminderStart}, {time.Now(), ev1, reminderStart}})
+
+	if _, ok := tracker.previousMessage([]reminder{{time.Now(), ev0, reminderStart}}); ok {
+		t.Error("message for more events is edited")
+	}
+
+	evID, ok := tracker.previousMessage([]reminder{{time.Now(), ev1, reminderStart}, {time.Now(), ev0, reminderStart}})
+	if !ok {
+		t.Fatal("message for the same events is not edited")
+	}
+	assertEqual(t, evID, id.EventID("$both"), "previous message is found")
+
+	tracker.snooze([]reminder{{time.Now(), ev0, reminderStart}}, time.Hour, func([]reminder) {})
+	if _, ok := tracker.previousMessage([]reminder{{time.Now(), ev0, reminderStart}, {time.Now(), ev1, reminderStart}}); ok {
+		t.Error("snoozed reminder is edited into an earlier message")
+	}
+}
+
+func TestFormatEventNames(t *testing.T) {
+	rems := []reminder{
+		{event: &calendarEvent{text: "Lunch"}},
+		{event: &calendarEvent{text: "R&D <sync>"}},
+	}
+
+	text, textF := formatEventNames(rems)
+	assertEqual(t, text, `"Lunch" and "R&D <sync>"`, "plain event names are quoted")
+	assertEqual(t, textF, "<b>Lunch</b> and <b>R&amp;D &lt;sync&gt;</b>", "event names are escaped in HTML")
+}
@@ -3,6 +3,9 @@ package main
 import (
 	"database/sql"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	"maunium.net/go/mautrix/id"
@@ -16,9 +19,49 @@ type sqlDB struct {
 	stmtAddCalendar       *sql.Stmt
 	stmtRemoveCalendar    *sql.Stmt
 
-	stmtFetchAllUsers    *sql.Stmt
-	stmtAddUser          *sql.Stmt
-	stmtUpdateUserRoomID *sql.Stmt
+	stmtUpdateCalendarNotifyChanges *sql.Stmt
+	stmtUpdateCalendarRoomID        *sql.Stmt
+
+	stmtFetchAllUsers      *sql.Stmt
+	stmtAddUser            *sql.Stmt
+	stmtUpdateUserRoomID   *sql.Stmt
+	stmtUpdateUserTimezone *sql.Stmt
+	stmtUpdateUserDigest   *sql.Stmt
+	stmtUpdateUserWeekly   *sql.Stmt
+
+	stmtUpdateUserReminderRepeat *sql.Stmt
+	stmtUpdateUserQuiet          *sql.Stmt
+	stmtUpdateUserChanges        *sql.Stmt
+	stmtUpdateUserReminderTimes  *sql.Stmt
+
+	stmtUpdateUserReminderTemplate *sql.Stmt
+	stmtUpdateUserReminderEnded    *sql.Stmt
+
+	stmtUpdateUserLeftAt    *sql.Stmt
+	stmtUpdateUserDisabled  *sql.Stmt
+	stmtRemoveUser          *sql.Stmt
+	stmtRemoveUserCalendars *sql.Stmt
+
+	stmtFetchAllUserRooms *sql.Stmt
+	stmtAddUserRoom       *sql.Stmt
+	stmtRemoveUserRoom    *sql.Stmt
+	stmtRemoveUserRooms   *sql.Stmt
+
+	stmtFetchPendingOutbox  *sql.Stmt
+	stmtAddOutboxMessage    *sql.Stmt
+	stmtRemoveOutboxMessage *sql.Stmt
+	stmtUpdateOutboxFailure *sql.Stmt
+
+	stmtCountOutbox *sql.Stmt
+
+	stmtAddAdminLog *sql.Stmt
+
+	stmtFetchSession  *sql.Stmt
+	stmtUpdateSession *sql.Stmt
+
+	stmtFetchSync        *sql.Stmt
+	stmtUpdateSyncFilter *sql.Stmt
+	stmtUpdateSyncToken  *sql.Stmt
 }
 
 func initSQLDB(path string) (*sqlDB, error) {
@@ -34,12 +77,12 @@ func initSQLDB(path string) (*sqlDB, error) {
 		return d, err
 	}
 
-	d.stmtFetchCalendars, err = db.Prepare("SELECT id, user_id, name, cal_type, uri FROM calendar WHERE user_id = ?;")
+	d.stmtFetchCalendars, err = db.Prepare("SELECT id, user_id, name, cal_type, uri, notify_changes, room_id FROM calendar WHERE user_id = ?;")
 	if err != nil {
 		return d, err
 	}
 
-	d.stmtFetchAllCalendars, err = db.Prepare("SELECT id, user_id, name, cal_type, uri FROM calendar;")
+	d.stmtFetchAllCalendars, err = db.Prepare("SELECT id, user_id, name, cal_type, uri, notify_changes, room_id FROM calendar;")
 	if err != nil {
 		return d, err
 	}
@@ -54,17 +97,172 @@ func initSQLDB(path string) (*sqlDB, error) {
 		return d, err
 	}
 
-	d.stmtFetchAllUsers, err = db.Prepare("SELECT user_id, room_id FROM user;")
+	d.stmtUpdateCalendarNotifyChanges, err = db.Prepare("UPDATE calendar SET notify_changes = ? WHERE id = ?;")
 	if err != nil {
 		return d, err
 	}
 
-	d.stmtAddUser, err = db.Prepare("INSERT INTO user (user_id, room_id) VALUES (?, ?);")
+	d.stmtUpdateCalendarRoomID, err = db.Prepare("UPDATE calendar SET room_id = ? WHERE id = ?;")
+	if err != nil {
+		return d, err
+	}
+
+	d.stmtFetchAllUsers, err = db.Prepare("SELECT user_id, room_id, timezone, digest_time, digest_skip_empty, weekly_preview, weekly_review, reminder_repeat, " +
+		"quiet_from, quiet_to, quiet_batch, paused_until, changes_notify, changes_horizon, " +
+		"reminder_end, allday_time, allday_day_before, reminder_template, reminder_template_html, reminder_ended, left_at, disabled, kind FROM user;")
+	if err != nil {
+		return d, err
+	}
+
+	d.stmtAddUser, err = db.Prepare("INSERT INTO user (user_id, room_id, kind) VALUES (?, ?, ?);")
 	if err != nil {
 		return d, err
 	}
 
 	d.stmtUpdateUserRoomID, err = db.Prepare("UPDATE user SET room_id = ? WHERE user_id = ?;")
+	if err != nil {
+		return d, err
+	}
+
+	d.stmtUpdateUserTimezone, err = db.Prepare("UPDATE user SET timezone = ? WHERE user_id = ?;")
+	if err != nil {
+		return d, err
+	}
+
+	d.stmtUpdateUserDigest, err = db.Prepare("UPDATE user SET digest_time = ?, digest_skip_empty = ? WHERE user_id = ?;")
+	if err != nil {
+		return d, err
+	}
+
+	d.stmtUpdateUserWeekly, err = db.Prepare("UPDATE user SET weekly_preview = ?, weekly_review = ? WHERE user_id = ?;")
+	if err != nil {
+		return d, err
+	}
+
+	d.stmtUpdateUserReminderRepeat, err = db.Prepare("UPDATE user SET reminder_repeat = ? WHERE user_id = ?;")
+	if err != nil {
+		return d, err
+	}
+
+	d.stmtUpdateUserQuiet, err = db.Prepare("UPDATE user SET quiet_from = ?, quiet_to = ?, quiet_batch = ?, paused_until = ? WHERE user_id = ?;")
+	if err != nil {
+		return d, err
+	}
+
+	d.stmtUpdateUserChanges, err = db.Prepare("UPDATE user SET changes_notify = ?, changes_horizon = ? WHERE user_id = ?;")
+	if err != nil {
+		return d, err
+	}
+
+	d.stmtUpdateUserReminderTimes, err = db.Prepare("UPDATE user SET reminder_end = ?, allday_time = ?, allday_day_before = ? WHERE user_id = ?;")
+	if err != nil {
+		return d, err
+	}
+
+	d.stmtUpdateUserReminderTemplate, err = db.Prepare("UPDATE user SET reminder_template = ?, reminder_template_html = ? WHERE user_id = ?;")
+	if err != nil {
+		return d, err
+	}
+
+	d.stmtUpdateUserReminderEnded, err = db.Prepare("UPDATE user SET reminder_ended = ? WHERE user_id = ?;")
+	if err != nil {
+		return d, err
+	}
+
+	d.stmtUpdateUserLeftAt, err = db.Prepare("UPDATE user SET left_at = ? WHERE user_id = ?;")
+	if err != nil {
+		return d, err
+	}
+
+	d.stmtUpdateUserDisabled, err = db.Prepare("UPDATE user SET disabled = ? WHERE user_id = ?;")
+	if err != nil {
+		return d, err
+	}
+
+	d.stmtRemoveUser, err = db.Prepare("DELETE FROM user WHERE user_id = ?;")
+	if err != nil {
+		return d, err
+	}
+
+	d.stmtRemoveUserCalendars, err = db.Prepare("DELETE FROM calendar WHERE user_id = ?;")
+	if err != nil {
+		return d, err
+	}
+
+	d.stmtFetchAllUserRooms, err = db.Prepare("SELECT user_id, room_id FROM user_room ORDER BY created;")
+	if err != nil {
+		return d, err
+	}
+
+	d.stmtAddUserRoom, err = db.Prepare("INSERT OR IGNORE INTO user_room (user_id, room_id) VALUES (?, ?);")
+	if err != nil {
+		return d, err
+	}
+
+	d.stmtRemoveUserRoom, err = db.Prepare("DELETE FROM user_room WHERE user_id = ? AND room_id = ?;")
+	if err != nil {
+		return d, err
+	}
+
+	d.stmtRemoveUserRooms, err = db.Prepare("DELETE FROM user_room WHERE user_id = ?;")
+	if err != nil {
+		return d, err
+	}
+
+	d.stmtFetchPendingOutbox, err = db.Prepare("SELECT id, room_id, content, created, attempts FROM outbox WHERE failed = 0 ORDER BY id;")
+	if err != nil {
+		return d, err
+	}
+
+	d.stmtAddOutboxMessage, err = db.Prepare("INSERT INTO outbox (room_id, content, created) VALUES (?, ?, ?);")
+	if err != nil {
+		return d, err
+	}
+
+	d.stmtRemoveOutboxMessage, err = db.Prepare("DELETE FROM outbox WHERE id = ?;")
+	if err != nil {
+		return d, err
+	}
+
+	d.stmtUpdateOutboxFailure, err = db.Prepare("UPDATE outbox SET attempts = ?, last_error = ?, failed = ? WHERE id = ?;")
+	if err != nil {
+		return d, err
+	}
+
+	d.stmtCountOutbox, err = db.Prepare("SELECT COALESCE(SUM(failed = 0), 0), COALESCE(SUM(failed = 1), 0) FROM outbox;")
+	if err != nil {
+		return d, err
+	}
+
+	d.stmtAddAdminLog, err = db.Prepare("INSERT INTO admin_log (user_id, command) VALUES (?, ?);")
+	if err != nil {
+		return d, err
+	}
+
+	d.stmtFetchSession, err = db.Prepare("SELECT device_id, access_token FROM session WHERE user_id = ?;")
+	if err != nil {
+		return d, err
+	}
+
+	d.stmtUpdateSession, err = db.Prepare("INSERT INTO session (user_id, device_id, access_token) VALUES (?, ?, ?) " +
+		"ON CONFLICT(user_id) DO UPDATE SET device_id = excluded.device_id, access_token = excluded.access_token;")
+	if err != nil {
+		return d, err
+	}
+
+	d.stmtFetchSync, err = db.Prepare("SELECT filter_id, next_batch FROM sync WHERE user_id = ?;")
+	if err != nil {
+		return d, err
+	}
+
+	d.stmtUpdateSyncFilter, err = db.Prepare("INSERT INTO sync (user_id, filter_id) VALUES (?, ?) " +
+		"ON CONFLICT(user_id) DO UPDATE SET filter_id = excluded.filter_id;")
+	if err != nil {
+		return d, err
+	}
+
+	d.stmtUpdateSyncToken, err = db.Prepare("INSERT INTO sync (user_id, next_batch) VALUES (?, ?) " +
+		"ON CONFLICT(user_id) DO UPDATE SET next_batch = excluded.next_batch;")
 	return d, err
 }
 
@@ -88,6 +286,142 @@ func (d *sqlDB) createTables() error {
 		"created" datetime default current_timestamp);`
 
 	_, err = d.db.Exec(calendarSQL)
+	if err != nil {
+		return err
+	}
+
+	// sync stores the state of syncing with the homeserver, so the bot can
+	// continue where it left off after a restart.
+	syncSQL := `CREATE TABLE IF NOT EXISTS sync (
+		"user_id" TEXT NOT NULL PRIMARY KEY,
+		"filter_id" TEXT NOT NULL DEFAULT '',
+		"next_batch" TEXT NOT NULL DEFAULT '');`
+
+	_, err = d.db.Exec(syncSQL)
+	if err != nil {
+		return err
+	}
+
+	// outbox stores scheduled messages until they are sent. Messages which
+	// couldn't be sent are kept with failed set, for the operator.
+	outboxSQL := `CREATE TABLE IF NOT EXISTS outbox (
+		"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"room_id" TEXT NOT NULL,
+		"content" TEXT NOT NULL,
+		"created" INTEGER NOT NULL,
+		"attempts" INTEGER NOT NULL DEFAULT 0,
+		"last_error" TEXT NOT NULL DEFAULT '',
+		"failed" INTEGER NOT NULL DEFAULT 0);`
+
+	_, err = d.db.Exec(outboxSQL)
+	if err != nil {
+		return err
+	}
+
+	// admin_log records the commands run by admins in the admin room.
+	adminLogSQL := `CREATE TABLE IF NOT EXISTS admin_log (
+		"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"user_id" TEXT NOT NULL,
+		"command" TEXT NOT NULL,
+		"created" datetime default current_timestamp);`
+
+	_, err = d.db.Exec(adminLogSQL)
+	if err != nil {
+		return err
+	}
+
+	// session stores the device and access token the bot got by logging in.
+	sessionSQL := `CREATE TABLE IF NOT EXISTS session (
+		"user_id" TEXT NOT NULL PRIMARY KEY,
+		"device_id" TEXT NOT NULL,
+		"access_token" TEXT NOT NULL);`
+
+	_, err = d.db.Exec(sessionSQL)
+	if err != nil {
+		return err
+	}
+
+	// user_room stores the rooms of users besides the one in the user table,
+	// which reminders are sent to.
+	userRoomSQL := `CREATE TABLE IF NOT EXISTS user_room (
+		"user_id" TEXT NOT NULL,
+		"room_id" TEXT NOT NULL,
+		"created" datetime default current_timestamp,
+		PRIMARY KEY ("user_id", "room_id"));`
+
+	_, err = d.db.Exec(userRoomSQL)
+	if err != nil {
+		return err
+	}
+
+	return d.migrateTables()
+}
+
+// migrateTables adds the columns introduced after the tables were first
+// created to databases created by older versions.
+func (d *sqlDB) migrateTables() error {
+	columns := []struct {
+		table, column, definition string
+	}{
+		{"user", "timezone", "TEXT NOT NULL DEFAULT ''"},
+		{"user", "digest_time", "TEXT NOT NULL DEFAULT ''"},
+		{"user", "digest_skip_empty", "INTEGER NOT NULL DEFAULT 0"},
+		{"user", "weekly_preview", "TEXT NOT NULL DEFAULT ''"},
+		{"user", "weekly_review", "TEXT NOT NULL DEFAULT ''"},
+		{"user", "reminder_repeat", "INTEGER NOT NULL DEFAULT 1"},
+		{"user", "quiet_from", "TEXT NOT NULL DEFAULT ''"},
+		{"user", "quiet_to", "TEXT NOT NULL DEFAULT ''"},
+		{"user", "quiet_batch", "INTEGER NOT NULL DEFAULT 0"},
+		{"user", "paused_until", "INTEGER NOT NULL DEFAULT 0"},
+		{"user", "changes_notify", "INTEGER NOT NULL DEFAULT 1"},
+		{"user", "changes_horizon", "INTEGER NOT NULL DEFAULT " + strconv.Itoa(int(defaultChangesHorizon.Seconds()))},
+		{"calendar", "notify_changes", "INTEGER NOT NULL DEFAULT 1"},
+		{"user", "reminder_end", "TEXT NOT NULL DEFAULT ''"},
+		{"user", "allday_time", "TEXT NOT NULL DEFAULT ''"},
+		{"user", "allday_day_before", "INTEGER NOT NULL DEFAULT 0"},
+		{"user", "reminder_template", "TEXT NOT NULL DEFAULT ''"},
+		{"user", "reminder_template_html", "TEXT NOT NULL DEFAULT ''"},
+		{"user", "reminder_ended", "TEXT NOT NULL DEFAULT ''"},
+		{"calendar", "room_id", "TEXT NOT NULL DEFAULT ''"},
+		{"user", "left_at", "INTEGER NOT NULL DEFAULT 0"},
+		{"user", "disabled", "INTEGER NOT NULL DEFAULT 0"},
+		{"user", "kind", "TEXT NOT NULL DEFAULT '" + string(userKindPerson) + "'"},
+	}
+
+	for _, c := range columns {
+		err := d.addColumn(c.table, c.column, c.definition)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addColumn adds the column to the table, unless the table already has it.
+func (d *sqlDB) addColumn(table, column, definition string) error {
+	rows, err := d.db.Query("PRAGMA table_info(" + table + ");")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt sql.NullString
+		err = rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk)
+		if err != nil {
+			return err
+		}
+
+		if strings.EqualFold(name, column) {
+			return nil
+		}
+	}
+	rows.Close()
+
+	_, err = d.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s;", table, column, definition))
 	return err
 }
 
@@ -101,13 +435,89 @@ func (d *sqlDB) fetchAllUsers() ([]*user, error) {
 	users := []*user{}
 	for rows.Next() {
 		user := &user{}
-		var roomID string
-		err = rows.Scan(&user.userID, &roomID)
+		var roomID, digestTime, weeklyPreview, weeklyReview, quietFrom, quietTo string
+		var reminderEnd, allDayTime string
+		var pausedUntil, changesHorizon, leftAt int64
+		err = rows.Scan(&user.userID, &roomID, &user.timezone, &digestTime, &user.digest.skipEmpty,
+			&weeklyPreview, &weeklyReview, &user.reminderRepeat,
+			&quietFrom, &quietTo, &user.quiet.batch, &pausedUntil,
+			&user.changes.enabled, &changesHorizon,
+			&reminderEnd, &allDayTime, &user.allDayReminder.dayBefore,
+			&user.reminderFormat.plain, &user.reminderFormat.html, &user.endedAction,
+			&leftAt, &user.disabled, &user.kind)
 		if err != nil {
 			return users, err
 		}
 		user.roomID = id.RoomID(roomID)
 
+		if user.timezone != "" {
+			user.loc, err = time.LoadLocation(user.timezone)
+			if err != nil {
+				fmt.Printf("unknown timezone in database: %q, user: %s\n", user.timezone, user.userID)
+			}
+		}
+
+		if digestTime != "" {
+			user.digest.at, err = parseTimeOfDay(digestTime)
+			if err != nil {
+				fmt.Printf("invalid digest time in database: %q, user: %s\n", digestTime, user.userID)
+			} else {
+				user.digest.enabled = true
+			}
+		}
+
+		if weeklyPreview != "" {
+			user.weeklyPreview, err = parseWeeklyTime(weeklyPreview)
+			if err != nil {
+				fmt.Printf("invalid weekly preview time in database: %q, user: %s\n", weeklyPreview, user.userID)
+			}
+		}
+
+		if weeklyReview != "" {
+			user.weeklyReview, err = parseWeeklyTime(weeklyReview)
+			if err != nil {
+				fmt.Printf("invalid weekly review time in database: %q, user: %s\n", weeklyReview, user.userID)
+			}
+		}
+
+		if quietFrom != "" && quietTo != "" {
+			user.quiet.from, err = parseTimeOfDay(quietFrom)
+			if err == nil {
+				user.quiet.to, err = parseTimeOfDay(quietTo)
+			}
+			if err != nil {
+				fmt.Printf("invalid quiet hours in database: %q - %q, user: %s\n", quietFrom, quietTo, user.userID)
+			} else {
+				user.quiet.enabled = true
+			}
+		}
+
+		if pausedUntil != 0 {
+			user.quiet.pausedUntil = time.Unix(pausedUntil, 0)
+		}
+
+		user.changes.horizon = time.Duration(changesHorizon) * time.Second
+
+		if leftAt != 0 {
+			user.leftAt = time.Unix(leftAt, 0)
+		}
+
+		if reminderEnd != "" {
+			user.endReminders, err = parseMinutesList(reminderEnd)
+			if err != nil {
+				fmt.Printf("invalid end reminders in database: %q, user: %s\n", reminderEnd, user.userID)
+			}
+		}
+
+		if allDayTime != "" {
+			user.allDayReminder.at, err = parseTimeOfDay(allDayTime)
+			if err != nil {
+				fmt.Printf("invalid all-day reminder time in database: %q, user: %s\n", allDayTime, user.userID)
+			} else {
+				user.allDayReminder.enabled = true
+			}
+		}
+
 		users = append(users, user)
 	}
 
@@ -139,13 +549,14 @@ func rowsToCalendars(rows *sql.Rows) ([]*userCalendar, error) {
 	for rows.Next() {
 		cal := &userCalendar{}
 		var userID string
-		var calTypeStr string
-		err := rows.Scan(&cal.DBID, &userID, &cal.Name, &calTypeStr, &cal.URI)
+		var calTypeStr, roomID string
+		err := rows.Scan(&cal.DBID, &userID, &cal.Name, &calTypeStr, &cal.URI, &cal.NotifyChanges, &roomID)
 		if err != nil {
 			return cals, err
 		}
 
 		cal.UserID = id.UserID(userID)
+		cal.RoomID = id.RoomID(roomID)
 
 		switch calTypeStr {
 		case "caldav":
@@ -179,14 +590,275 @@ func (d *sqlDB) removeCalendar(userID id.UserID, name string) error {
 	return err
 }
 
+func (d *sqlDB) updateCalendarNotifyChanges(calID int64, notify bool) error {
+	_, err := d.stmtUpdateCalendarNotifyChanges.Exec(notify, calID)
+
+	return err
+}
+
+func (d *sqlDB) updateCalendarRoomID(calID int64, roomID id.RoomID) error {
+	_, err := d.stmtUpdateCalendarRoomID.Exec(roomID, calID)
+
+	return err
+}
+
 func (d *sqlDB) updateUserRoomID(userID id.UserID, roomID id.RoomID) error {
 	_, err := d.stmtUpdateUserRoomID.Exec(roomID, userID)
 
 	return err
 }
 
-func (d *sqlDB) addUser(userID id.UserID, roomID id.RoomID) error {
-	_, err := d.stmtAddUser.Exec(userID, roomID)
+func (d *sqlDB) updateUserTimezone(userID id.UserID, timezone string) error {
+	_, err := d.stmtUpdateUserTimezone.Exec(timezone, userID)
+
+	return err
+}
+
+func (d *sqlDB) updateUserDigest(userID id.UserID, ds digestSettings) error {
+	digestTime := ""
+	if ds.enabled {
+		digestTime = ds.at.String()
+	}
+
+	_, err := d.stmtUpdateUserDigest.Exec(digestTime, ds.skipEmpty, userID)
+
+	return err
+}
+
+func (d *sqlDB) updateUserWeekly(userID id.UserID, preview, review weeklyTime) error {
+	previewStr, reviewStr := "", ""
+	if preview.enabled {
+		previewStr = preview.String()
+	}
+	if review.enabled {
+		reviewStr = review.String()
+	}
+
+	_, err := d.stmtUpdateUserWeekly.Exec(previewStr, reviewStr, userID)
+
+	return err
+}
+
+func (d *sqlDB) updateUserReminderRepeat(userID id.UserID, repeat bool) error {
+	_, err := d.stmtUpdateUserReminderRepeat.Exec(repeat, userID)
+
+	return err
+}
+
+func (d *sqlDB) updateUserQuiet(userID id.UserID, qs quietSettings) error {
+	quietFrom, quietTo := "", ""
+	if qs.enabled {
+		quietFrom = qs.from.String()
+		quietTo = qs.to.String()
+	}
+
+	pausedUntil := int64(0)
+	if !qs.pausedUntil.IsZero() {
+		pausedUntil = qs.pausedUntil.Unix()
+	}
+
+	_, err := d.stmtUpdateUserQuiet.Exec(quietFrom, quietTo, qs.batch, pausedUntil, userID)
+
+	return err
+}
+
+func (d *sqlDB) updateUserChanges(userID id.UserID, cs changeSettings) error {
+	_, err := d.stmtUpdateUserChanges.Exec(cs.enabled, int64(cs.horizon.Seconds()), userID)
+
+	return err
+}
+
+func (d *sqlDB) updateUserReminderTimes(userID id.UserID, endReminders []time.Duration, allDay allDayReminder) error {
+	allDayTime := ""
+	if allDay.enabled {
+		allDayTime = allDay.at.String()
+	}
+
+	_, err := d.stmtUpdateUserReminderTimes.Exec(formatMinutesList(endReminders), allDayTime, allDay.dayBefore, userID)
+
+	return err
+}
+
+func (d *sqlDB) updateUserReminderTemplate(userID id.UserID, tmpl reminderTemplate) error {
+	_, err := d.stmtUpdateUserReminderTemplate.Exec(tmpl.plain, tmpl.html, userID)
+
+	return err
+}
+
+func (d *sqlDB) updateUserReminderEnded(userID id.UserID, action reminderEndedAction) error {
+	_, err := d.stmtUpdateUserReminderEnded.Exec(string(action), userID)
+
+	return err
+}
+
+func (d *sqlDB) updateUserLeftAt(userID id.UserID, leftAt time.Time) error {
+	unix := int64(0)
+	if !leftAt.IsZero() {
+		unix = leftAt.Unix()
+	}
+
+	_, err := d.stmtUpdateUserLeftAt.Exec(unix, userID)
+
+	return err
+}
+
+func (d *sqlDB) updateUserDisabled(userID id.UserID, disabled bool) error {
+	_, err := d.stmtUpdateUserDisabled.Exec(disabled, userID)
+
+	return err
+}
+
+// removeUser deletes the user, its calendars and its rooms.
+func (d *sqlDB) removeUser(userID id.UserID) error {
+	_, err := d.stmtRemoveUserCalendars.Exec(userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.stmtRemoveUserRooms.Exec(userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.stmtRemoveUser.Exec(userID)
+
+	return err
+}
+
+// fetchAllUserRooms gives the other rooms of all users, oldest first.
+func (d *sqlDB) fetchAllUserRooms() (map[id.UserID][]id.RoomID, error) {
+	rows, err := d.stmtFetchAllUserRooms.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rooms := make(map[id.UserID][]id.RoomID)
+	for rows.Next() {
+		var userID, roomID string
+		err = rows.Scan(&userID, &roomID)
+		if err != nil {
+			return nil, err
+		}
+
+		rooms[id.UserID(userID)] = append(rooms[id.UserID(userID)], id.RoomID(roomID))
+	}
+
+	return rooms, rows.Err()
+}
+
+func (d *sqlDB) addUserRoom(userID id.UserID, roomID id.RoomID) error {
+	_, err := d.stmtAddUserRoom.Exec(userID, roomID)
+
+	return err
+}
+
+func (d *sqlDB) removeUserRoom(userID id.UserID, roomID id.RoomID) error {
+	_, err := d.stmtRemoveUserRoom.Exec(userID, roomID)
+
+	return err
+}
+
+func (d *sqlDB) fetchPendingOutbox() ([]outboxMessage, error) {
+	rows, err := d.stmtFetchPendingOutbox.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	msgs := []outboxMessage{}
+	for rows.Next() {
+		var msg outboxMessage
+		var roomID string
+		var created int64
+		err = rows.Scan(&msg.dbID, &roomID, &msg.content, &created, &msg.attempts)
+		if err != nil {
+			return nil, err
+		}
+
+		msg.roomID = id.RoomID(roomID)
+		msg.created = time.Unix(created, 0)
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, rows.Err()
+}
+
+func (d *sqlDB) addOutboxMessage(roomID id.RoomID, content string) (int64, error) {
+	res, err := d.stmtAddOutboxMessage.Exec(roomID, content, time.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+
+	return res.LastInsertId()
+}
+
+func (d *sqlDB) removeOutboxMessage(dbID int64) error {
+	_, err := d.stmtRemoveOutboxMessage.Exec(dbID)
+
+	return err
+}
+
+func (d *sqlDB) updateOutboxFailure(dbID int64, attempts int, lastError string, failed bool) error {
+	_, err := d.stmtUpdateOutboxFailure.Exec(attempts, lastError, failed, dbID)
+
+	return err
+}
+
+// countOutbox gives the number of messages waiting to be sent, and of
+// messages which couldn't be sent.
+func (d *sqlDB) countOutbox() (pending int, failed int, err error) {
+	err = d.stmtCountOutbox.QueryRow().Scan(&pending, &failed)
+
+	return pending, failed, err
+}
+
+func (d *sqlDB) addAdminLog(userID id.UserID, command string) error {
+	_, err := d.stmtAddAdminLog.Exec(userID, command)
+
+	return err
+}
+
+// fetchSession gives the stored device and access token of the bot account,
+// which are empty if the bot didn't log in yet.
+func (d *sqlDB) fetchSession(userID id.UserID) (deviceID id.DeviceID, accessToken string, err error) {
+	err = d.stmtFetchSession.QueryRow(userID).Scan(&deviceID, &accessToken)
+	if err == sql.ErrNoRows {
+		return "", "", nil
+	}
+
+	return deviceID, accessToken, err
+}
+
+func (d *sqlDB) updateSession(userID id.UserID, deviceID id.DeviceID, accessToken string) error {
+	_, err := d.stmtUpdateSession.Exec(userID, deviceID, accessToken)
+
+	return err
+}
+
+func (d *sqlDB) fetchSync(userID id.UserID) (filterID string, nextBatch string, err error) {
+	err = d.stmtFetchSync.QueryRow(userID).Scan(&filterID, &nextBatch)
+	if err == sql.ErrNoRows {
+		return "", "", nil
+	}
+
+	return filterID, nextBatch, err
+}
+
+func (d *sqlDB) updateSyncFilter(userID id.UserID, filterID string) error {
+	_, err := d.stmtUpdateSyncFilter.Exec(userID, filterID)
+
+	return err
+}
+
+func (d *sqlDB) updateSyncToken(userID id.UserID, nextBatch string) error {
+	_, err := d.stmtUpdateSyncToken.Exec(userID, nextBatch)
+
+	return err
+}
+
+func (d *sqlDB) addUser(userID id.UserID, roomID id.RoomID, kind userKind) error {
+	_, err := d.stmtAddUser.Exec(userID, roomID, kind)
 
 	return err
 }
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"net/url"
+	"regexp"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// reminderTemplate configures how an event is described in reminders. The
+// templates are executed with reminderTemplateData, empty templates use the
+// defaults.
+type reminderTemplate struct {
+	plain string
+	html  string
+}
+
+const (
+	defaultReminderTemplate     = `{{printf "%q" .Title}} {{.When}}{{if .Link}} - Join: {{.Link}}{{end}}`
+	defaultReminderTemplateHTML = `<b>{{.Title}}</b> {{.When}}{{if .Link}} - <a href="{{.Link}}">Join</a>{{end}}`
+)
+
+// reminderTemplateData is available in reminder templates.
+type reminderTemplateData struct {
+	Title       string
+	When        string
+	Time        string
+	Start, End  time.Time
+	Location    string
+	Description string
+	Calendar    string
+	Link        string
+}
+
+func newReminderTemplateData(rem reminder, now time.Time, loc *time.Location) reminderTemplateData {
+	ev := rem.event
+
+	return reminderTemplateData{
+		Title:       ev.text,
+		When:        rem.describe(now),
+		Time:        ev.from.In(loc).Format("15:04"),
+		Start:       ev.from.In(loc),
+		End:         ev.to.In(loc),
+		Location:    ev.location,
+		Description: ev.description,
+		Calendar:    ev.calendar,
+		Link:        meetingLink(ev.location, ev.description),
+	}
+}
+
+// validate parses and executes the templates on an example event, so mistakes
+// show up when the template is set instead of when reminding.
+func (t reminderTemplate) validate() error {
+	now := time.Now()
+	ev := &calendarEvent{
+		from:        now.Add(30 * time.Minute),
+		to:          now.Add(90 * time.Minute),
+		text:        "Example",
+		location:    "https://meet.jit.si/example",
+		description: "Example description",
+		calendar:    "example",
+	}
+
+	_, _, err := t.format(reminder{ev.from.Add(-30 * time.Minute), ev, reminderStart}, now, time.Local)
+	return err
+}
+
+// format gives the plain and HTML description of the event of the reminder.
+func (t reminderTemplate) format(rem reminder, now time.Time, loc *time.Location) (string, string, error) {
+	plain, html := t.plain, t.html
+	if plain == "" {
+		plain = defaultReminderTemplate
+	}
+	if html == "" {
+		html = defaultReminderTemplateHTML
+	}
+
+	data := newReminderTemplateData(rem, now, loc)
+
+	textT, err := texttemplate.New("reminder").Parse(plain)
+	if err != nil {
+		return "", "", err
+	}
+	var text bytes.Buffer
+	err = textT.Execute(&text, data)
+	if err != nil {
+		return "", "", err
+	}
+
+	htmlT, err := htmltemplate.New("reminder").Parse(html)
+	if err != nil {
+		return "", "", err
+	}
+	var textF bytes.Buffer
+	err = htmlT.Execute(&textF, data)
+	if err != nil {
+		return "", "", err
+	}
+
+	return text.String(), textF.String(), nil
+}
+
+var urlPattern = regexp.MustCompile(`https?://[^\s<>"']+`)
+
+// meetingHosts are the hosts, and their subdomains, of video-conferencing services.
+var meetingHosts = []string{
+	"meet.jit.si",
+	"zoom.us",
+	"meet.google.com",
+	"teams.microsoft.com",
+	"teams.live.com",
+}
+
+// meetingLink gives the first video-conference URL found in the texts, or an
+// empty string.
+func meetingLink(texts ...string) string {
+	for _, text := range texts {
+		for _, match := range urlPattern.FindAllString(text, -1) {
+			match = strings.TrimRight(match, ".,;:!?)]}")
+
+			u, err := url.Parse(match)
+			if err != nil {
+				continue
+			}
+
+			if isMeetingHost(strings.ToLower(u.Hostname())) {
+				return match
+			}
+		}
+	}
+
+	return ""
+}
+
+func isMeetingHost(host string) bool {
+	// Jitsi is often self-hosted, like on jitsi.example.org.
+	if strings.Contains(host, "jitsi") {
+		return true
+	}
+
+	for _, h := range meetingHosts {
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+
+	return false
+}
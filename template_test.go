@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMeetingLink(t *testing.T) {
+	var tests = []struct {
+		location, description string
+
+		expect string
+	}{
+		{"https://meet.jit.si/standup", "", "https://meet.jit.si/standup"},
+		{"Room 3", "Join: https://us02web.zoom.us/j/123456789?pwd=abc.", "https://us02web.zoom.us/j/123456789?pwd=abc"},
+		{"", "Agenda at https://example.org/agenda\nhttps://meet.google.com/abc-defg-hij", "https://meet.google.com/abc-defg-hij"},
+		{"", "<https://teams.microsoft.com/l/meetup-join/19%3ameeting>", "https://teams.microsoft.com/l/meetup-join/19%3ameeting"},
+		{"https://jitsi.example.org/weekly", "", "https://jitsi.example.org/weekly"},
+		{"Room 3", "https://example.org/zoom.us", ""},
+	}
+
+	for _, test := range tests {
+		assertEqual(t, meetingLink(test.location, test.description), test.expect, "meeting link is extracted")
+	}
+}
+
+func TestReminderTemplateFormat(t *testing.T) {
+	now := time.Date(2020, 11, 9, 10, 0, 0, 0, time.Local)
+
+	ev := &calendarEvent{
+		from:     now.Add(10 * time.Minute),
+		to:       now.Add(time.Hour),
+		text:     "standup",
+		location: "https://meet.jit.si/standup",
+		calendar: "work",
+	}
+	rem := reminder{now, ev, reminderStart}
+
+	text, textF, err := reminderTemplate{}.format(rem, now, time.Local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, text, `"standup" starts in 10 minutes - Join: https://meet.jit.si/standup`, "default template is formatted")
+	assertEqual(t, textF, `<b>standup</b> starts in 10 minutes - <a href="https://meet.jit.si/standup">Join</a>`, "default HTML template is formatted")
+
+	tmpl := reminderTemplate{plain: "{{.Calendar}}: {{.Title}} at {{.Time}}"}
+	text, _, err = tmpl.format(rem, now, time.Local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, text, "work: standup at 10:10", "custom template is formatted")
+
+	err = reminderTemplate{plain: "{{.Title"}.validate()
+	if err == nil {
+		t.Error("invalid template is accepted")
+	}
+}
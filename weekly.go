@@ -0,0 +1,253 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+	"time"
+)
+
+// weeklyTime is the moment in the week at which a weekly message is sent.
+type weeklyTime struct {
+	enabled bool
+	weekday time.Weekday
+	at      timeOfDay
+}
+
+var errInvalidWeekday = errors.New("invalid weekday")
+
+func parseWeekday(str string) (time.Weekday, error) {
+	str = strings.ToLower(str)
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		name := strings.ToLower(d.String())
+		if str == name || str == name[:3] {
+			return d, nil
+		}
+	}
+
+	return time.Sunday, errInvalidWeekday
+}
+
+// parseWeeklyTime parses weekly times formatted like "sunday 19:00", as
+// given by weeklyTime.String.
+func parseWeeklyTime(str string) (weeklyTime, error) {
+	parts := strings.Split(str, " ")
+	if len(parts) != 2 {
+		return weeklyTime{}, errInvalidWeekday
+	}
+
+	weekday, err := parseWeekday(parts[0])
+	if err != nil {
+		return weeklyTime{}, err
+	}
+
+	at, err := parseTimeOfDay(parts[1])
+	if err != nil {
+		return weeklyTime{}, err
+	}
+
+	return weeklyTime{enabled: true, weekday: weekday, at: at}, nil
+}
+
+func (w weeklyTime) String() string {
+	return strings.ToLower(w.weekday.String()) + " " + w.at.String()
+}
+
+var (
+	defaultWeeklyPreview = weeklyTime{enabled: true, weekday: time.Sunday, at: timeOfDay{19, 0}}
+	defaultWeeklyReview  = weeklyTime{enabled: true, weekday: time.Friday, at: timeOfDay{17, 0}}
+)
+
+// setWeekly stores the weekly preview and review settings, and reschedules them.
+func (u *user) setWeekly(preview, review weeklyTime) error {
+	u.mutex.RLock()
+	userID := u.userID
+	u.mutex.RUnlock()
+
+	err := u.persist.updateUserWeekly(userID, preview, review)
+	if err != nil {
+		return err
+	}
+
+	u.mutex.Lock()
+	u.weeklyPreview = preview
+	u.weeklyReview = review
+	u.mutex.Unlock()
+
+	u.restartWeeklyTimers()
+
+	return nil
+}
+
+func (u *user) weeklySettings() (preview, review weeklyTime) {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	return u.weeklyPreview, u.weeklyReview
+}
+
+// restartWeeklyTimers stops the current weekly timers of the user, and starts
+// new ones for the weekly messages the user has enabled.
+func (u *user) restartWeeklyTimers() {
+	u.mutex.Lock()
+
+	for _, timer := range []*recurringTimer{u.previewTimer, u.reviewTimer} {
+		if timer != nil {
+			timer.stop()
+		}
+	}
+	u.previewTimer = nil
+	u.reviewTimer = nil
+
+	if u.sender == nil || !u.leftAt.IsZero() || u.disabled {
+		u.mutex.Unlock()
+		return
+	}
+
+	// next runs with the mutex of the timer held, so it mustn't take the
+	// mutex of the user, which is held while stopping the timer.
+	loc := u.loc
+	if loc == nil {
+		loc = time.Local
+	}
+
+	newTimer := func(w weeklyTime, fn func()) *recurringTimer {
+		if !w.enabled {
+			return nil
+		}
+
+		next := func(after time.Time) time.Time {
+			return w.at.nextWeekly(after, w.weekday, loc)
+		}
+		return newRecurringTimer(next, fn)
+	}
+
+	u.previewTimer = newTimer(u.weeklyPreview, u.sendWeeklyPreview)
+	u.reviewTimer = newTimer(u.weeklyReview, u.sendWeeklyReview)
+	timers := []*recurringTimer{u.previewTimer, u.reviewTimer}
+	u.mutex.Unlock()
+
+	for _, timer := range timers {
+		if timer != nil {
+			timer.start()
+		}
+	}
+}
+
+// sendWeeklyPreview sends the agenda of next week to the room of the user.
+func (u *user) sendWeeklyPreview() {
+	if !u.hasCalendars() {
+		return
+	}
+
+	reply, err := cmdListEvents(u, "nextweek", 0, 0)
+	if err != nil {
+		fmt.Println("weekly preview:", u.userID, err)
+		return
+	}
+
+	_, err = u.messageSender().sendMessage(u.RoomID(), reply.msg, reply.msgF, true).wait()
+	if err != nil {
+		fmt.Println("weekly preview:", u.userID, err)
+	}
+}
+
+// sendWeeklyReview sends the review of this week to the room of the user.
+func (u *user) sendWeeklyReview() {
+	if !u.hasCalendars() {
+		return
+	}
+
+	reply, err := weeklyReview(u, time.Now())
+	if err != nil {
+		fmt.Println("weekly review:", u.userID, err)
+		return
+	}
+
+	_, err = u.messageSender().sendMessage(u.RoomID(), reply.msg, reply.msgF, true).wait()
+	if err != nil {
+		fmt.Println("weekly review:", u.userID, err)
+	}
+}
+
+// weeklyReview lists the events of this week up to now, followed by the total
+// time spent in meetings per calendar. All-day events are not counted as meetings.
+func weeklyReview(u *user, now time.Time) (cmdReply, error) {
+	loc := u.location()
+	now = now.In(loc)
+	from := timeStartOfWeek(now, loc)
+	to := now
+
+	cal, err := u.combinedCalendar()
+	if err != nil {
+		return cmdReply{}, err
+	}
+
+	evs, err := cal.eventsBetween(from, to)
+	if err == errNoCalendars {
+		return replyNoCalendars, nil
+	}
+	if err != nil {
+		return cmdReply{}, err
+	}
+
+	_, week := from.ISOWeek()
+	reply := formatEvents(evs, to, loc, week)
+
+	lines := []string{reply.msg, "", "Time spent in meetings"}
+	linesF := []string{reply.msgF, "", "<b>Time spent in meetings</b>"}
+
+	u.calendarsMutex.RLock()
+	defer u.calendarsMutex.RUnlock()
+
+	for _, uc := range u.calendars {
+		cal, err := uc.calendar()
+		if err != nil {
+			return cmdReply{}, err
+		}
+
+		evs, err := cal.events()
+		if err != nil {
+			return cmdReply{}, err
+		}
+
+		total := meetingDuration(evs.between(from, to))
+
+		lines = append(lines, fmt.Sprintf("%s: %s", uc.Name, formatHours(total)))
+		linesF = append(linesF, fmt.Sprintf("<b>%s</b>: %s", html.EscapeString(uc.Name), formatHours(total)))
+	}
+
+	return cmdReply{strings.Join(lines, "\n"), strings.Join(linesF, "<br />")}, nil
+}
+
+// meetingDuration gives the total duration of the events, excluding all-day events.
+func meetingDuration(evs calendarEvents) time.Duration {
+	total := time.Duration(0)
+	for _, ev := range evs {
+		if ev.allDay() {
+			continue
+		}
+
+		total += ev.to.Sub(ev.from)
+	}
+
+	return total
+}
+
+func formatHours(d time.Duration) string {
+	hours := d.Hours()
+	if hours == 1 {
+		return "1 hour"
+	}
+
+	return strings.TrimSuffix(fmt.Sprintf("%.1f", hours), ".0") + " hours"
+}
+
+func setupWeeklyTimers(data *store) {
+	data.usersMutex.RLock()
+	defer data.usersMutex.RUnlock()
+
+	for _, u := range data.users {
+		u.restartWeeklyTimers()
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseWeeklyTime(t *testing.T) {
+	w, err := parseWeeklyTime("sun 19:00")
+	if err != nil {
+		t.Error(err)
+	}
+
+	assertEqual(t, w, weeklyTime{true, time.Sunday, timeOfDay{19, 0}}, "weekly time is parsed")
+	assertEqual(t, w.String(), "sunday 19:00", "weekly time is formatted")
+
+	_, err = parseWeeklyTime("someday 19:00")
+	if err == nil {
+		t.Error("expected error for invalid weekday")
+	}
+}
+
+func TestMeetingDurationSkipsAllDayEvents(t *testing.T) {
+	evs := calendarEvents{
+		{
+			from: time.Date(2020, 11, 9, 10, 0, 0, 0, time.Local),
+			to:   time.Date(2020, 11, 9, 11, 30, 0, 0, time.Local),
+			text: "meeting",
+		},
+		{
+			from: time.Date(2020, 11, 10, 0, 0, 0, 0, time.Local),
+			to:   time.Date(2020, 11, 11, 0, 0, 0, 0, time.Local),
+			text: "all day",
+		},
+		{
+			from: time.Date(2020, 11, 11, 14, 0, 0, 0, time.Local),
+			to:   time.Date(2020, 11, 11, 16, 0, 0, 0, time.Local),
+			text: "another meeting",
+		},
+	}
+
+	got := meetingDuration(evs)
+
+	assertEqual(t, got, 3*time.Hour+30*time.Minute, "all-day events are skipped")
+	assertEqual(t, formatHours(got), "3.5 hours", "hours are formatted")
+}
+
+func TestWeeklyReviewStopsAtNow(t *testing.T) {
+	now := time.Date(2020, 11, 11, 12, 0, 0, 0, time.Local)
+	evs := mockCalendar{
+		{
+			from: time.Date(2020, 11, 9, 10, 0, 0, 0, time.Local),
+			to:   time.Date(2020, 11, 9, 11, 0, 0, 0, time.Local),
+			text: "planning",
+		},
+		{
+			from: time.Date(2020, 11, 11, 14, 0, 0, 0, time.Local),
+			to:   time.Date(2020, 11, 11, 15, 0, 0, 0, time.Local),
+			text: "retro",
+		},
+	}
+	u := &user{calendars: []*userCalendar{{Name: "work", cal: evs}}}
+
+	reply, err := weeklyReview(u, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, strings.Contains(reply.msg, "planning"), true, "past events are reviewed")
+	assertEqual(t, strings.Contains(reply.msg, "retro"), false, "upcoming events aren't reviewed")
+	assertEqual(t, strings.HasSuffix(reply.msg, "work: 1 hour"), true, "only past meetings are counted: "+reply.msg)
+}